@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/caarlos0/env/v11"
+	"github.com/k11v/outbox/internal/inbox"
+	"github.com/k11v/outbox/internal/kafkautil"
+	"github.com/k11v/outbox/internal/postgresutil"
+)
+
+// config holds the application configuration.
+type config struct {
+	Development bool                `env:"OUTBOX_DEVELOPMENT"`
+	GroupID     string              `env:"OUTBOX_CONSUMER_GROUP_ID,required"` // required
+	Inbox       inbox.Config        `envPrefix:"OUTBOX_INBOX_"`
+	Kafka       kafkautil.Config    `envPrefix:"OUTBOX_KAFKA_"`
+	Postgres    postgresutil.Config `envPrefix:"OUTBOX_POSTGRES_"`
+	Topics      []string            `env:"OUTBOX_CONSUMER_TOPICS,required" envSeparator:","` // required
+}
+
+// parseConfig parses the application configuration from the environment variables.
+func parseConfig(environ []string) (config, error) {
+	cfg := config{}
+
+	err := env.ParseWithOptions(&cfg, env.Options{
+		Environment: env.ToMap(environ),
+	})
+	if err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/k11v/outbox/internal/inbox"
+	"github.com/k11v/outbox/internal/kafkautil"
+	"github.com/k11v/outbox/internal/postgresutil"
+	"github.com/segmentio/kafka-go"
+)
+
+func main() {
+	if err := run(os.Stdout, os.Environ()); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func run(stdout io.Writer, environ []string) error {
+	cfg, err := parseConfig(environ)
+	if err != nil {
+		return err
+	}
+	log := newLogger(stdout, cfg.Development)
+
+	ctx := context.Background()
+
+	kafkaReader := kafkautil.NewReader(cfg.Kafka, cfg.GroupID, cfg.Topics)
+	defer closeWithLog(kafkaReader, log)
+
+	postgresPool, err := postgresutil.NewPool(ctx, log, cfg.Postgres, cfg.Development)
+	if err != nil {
+		return err
+	}
+	defer postgresPool.Close()
+
+	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(runCtx, func() {
+		log.Info("shutting down")
+	})
+
+	log.Info(
+		"starting consumer",
+		"development", cfg.Development,
+		"group_id", cfg.GroupID,
+		"topics", cfg.Topics,
+	)
+	i := inbox.NewInbox(cfg.Inbox, log, kafkaReader, postgresPool)
+	i.Run(runCtx, func(_ context.Context, _ pgx.Tx, msg kafka.Message) error {
+		// A real consumer makes its writes in the transaction, so they are made once per message.
+		log.Info("consumed message", "topic", msg.Topic, "key", string(msg.Key), "value", string(msg.Value))
+		return nil
+	})
+	log.Info("stopped consumer")
+
+	return nil
+}
+
+func closeWithLog(c io.Closer, log *slog.Logger) {
+	if err := c.Close(); err != nil {
+		log.Error("failed to close", "error", err)
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"github.com/caarlos0/env/v11"
+	"github.com/k11v/outbox/internal/partition"
 	"github.com/k11v/outbox/internal/postgresutil"
+	"github.com/k11v/outbox/internal/worker"
 )
 
 // config holds the application configuration.
 type config struct {
-	Postgres postgresutil.Config `envPrefix:"OUTBOX_POSTGRES_"`
+	Postgres  postgresutil.Config `envPrefix:"OUTBOX_POSTGRES_"`
+	CDC       worker.CDCConfig    `envPrefix:"OUTBOX_WORKER_CDC_"` // shared with the worker
+	Partition partition.Config    `envPrefix:"OUTBOX_PARTITION_"`  // shared with the worker
 }
 
 // parseConfig parses the application configuration from the environment variables.
@@ -13,8 +13,11 @@ import (
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/k11v/outbox/internal/partition"
 	"github.com/k11v/outbox/internal/postgresutil"
+	"github.com/k11v/outbox/internal/worker"
 )
 
 func main() {
@@ -45,6 +48,20 @@ func run(environ []string) error {
 		return err
 	}
 
+	// Partitioning recreates outbox_messages, so it comes before change data capture that publishes it.
+
+	if cfg.Partition.Enabled {
+		if err = setupPartitions(ctx, cfg.Postgres, cfg.Partition); err != nil {
+			return err
+		}
+	}
+
+	if cfg.CDC.Enabled {
+		if err = setupCDC(ctx, cfg.Postgres, cfg.CDC); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -81,6 +98,36 @@ func migrateDB(db *sql.DB) error {
 	return nil
 }
 
+func setupCDC(ctx context.Context, postgresCfg postgresutil.Config, cdcCfg worker.CDCConfig) error {
+	conn, err := pgx.Connect(ctx, postgresCfg.DSN)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer func() {
+		_ = conn.Close(ctx)
+	}()
+
+	if err = worker.SetupCDC(ctx, conn, cdcCfg); err != nil {
+		return fmt.Errorf("failed to set up change data capture: %w", err)
+	}
+	return nil
+}
+
+func setupPartitions(ctx context.Context, postgresCfg postgresutil.Config, partitionCfg partition.Config) error {
+	conn, err := pgx.Connect(ctx, postgresCfg.DSN)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer func() {
+		_ = conn.Close(ctx)
+	}()
+
+	if err = partition.Setup(ctx, conn, partitionCfg); err != nil {
+		return fmt.Errorf("failed to set up partitions: %w", err)
+	}
+	return nil
+}
+
 func closeWithLog(c io.Closer, log *slog.Logger) {
 	if err := c.Close(); err != nil {
 		log.Error("failed to close", "error", err)
@@ -0,0 +1,18 @@
+BEGIN;
+
+-- Idempotency keys of POST /messages requests with the responses to replay when a request is retried.
+-- Keys are scoped per client, see the X-Client-ID header.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    client text NOT NULL,
+    key text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    request_hash bytea NOT NULL, -- SHA-256 of the request, to detect reuse of the key with a different request
+    response_status integer,
+    response_body bytea,
+
+    PRIMARY KEY (client, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+
+COMMIT;
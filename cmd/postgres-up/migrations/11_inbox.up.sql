@@ -0,0 +1,16 @@
+BEGIN;
+
+-- Messages processed by consumers that use the inbox, to process each message once.
+-- Rows are written in the same transaction as the consumer's own writes.
+CREATE TABLE IF NOT EXISTS inbox_messages (
+    consumer text NOT NULL,
+    message_id text NOT NULL, -- e.g. the outbox-id header
+    topic text NOT NULL,
+    partition integer NOT NULL,
+    "offset" bigint NOT NULL,
+    processed_at timestamp with time zone NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (consumer, message_id)
+);
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP TABLE IF EXISTS outbox_cursors;
+
+DROP INDEX IF EXISTS outbox_messages_pending_commit_seq_idx;
+DROP INDEX IF EXISTS outbox_messages_commit_seq_idx;
+
+ALTER TABLE outbox_messages DROP COLUMN IF EXISTS commit_seq;
+DROP SEQUENCE IF EXISTS outbox_messages_commit_seq;
+
+COMMIT;
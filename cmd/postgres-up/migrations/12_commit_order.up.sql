@@ -0,0 +1,20 @@
+BEGIN;
+
+-- commit_seq orders messages by commit in commit order mode. It's assigned by the worker once the transaction that
+-- inserted the message has committed, so it's NULL until then and in other modes.
+-- The sequence isn't owned by the column, so it survives the move of outbox_messages to a partitioned table.
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS commit_seq bigint;
+CREATE SEQUENCE IF NOT EXISTS outbox_messages_commit_seq;
+
+CREATE INDEX IF NOT EXISTS outbox_messages_commit_seq_idx ON outbox_messages (commit_seq);
+CREATE INDEX IF NOT EXISTS outbox_messages_pending_commit_seq_idx ON outbox_messages (commit_seq)
+    WHERE status IN ('undelivered', 'claimed');
+
+-- High-water marks of commit_seq up to which every message is delivered, dead or expired.
+CREATE TABLE IF NOT EXISTS outbox_cursors (
+    name text PRIMARY KEY,
+    position bigint NOT NULL DEFAULT 0,
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+UPDATE outbox_messages SET status = 'undelivered' WHERE status = 'claimed';
+
+ALTER TABLE outbox_messages DROP CONSTRAINT IF EXISTS outbox_messages_status_check;
+ALTER TABLE outbox_messages ADD CONSTRAINT outbox_messages_status_check
+    CHECK (status IN ('undelivered', 'delivered'));
+
+ALTER TABLE outbox_messages
+    DROP COLUMN IF EXISTS claimed_until,
+    DROP COLUMN IF EXISTS claimed_by;
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE outbox_messages
+    ADD COLUMN IF NOT EXISTS claimed_by text, -- ID of the worker that holds the lease
+    ADD COLUMN IF NOT EXISTS claimed_until timestamp with time zone; -- when the lease expires
+
+ALTER TABLE outbox_messages DROP CONSTRAINT IF EXISTS outbox_messages_status_check;
+ALTER TABLE outbox_messages ADD CONSTRAINT outbox_messages_status_check
+    CHECK (status IN ('undelivered', 'claimed', 'delivered'));
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE outbox_messages
+    DROP COLUMN IF EXISTS next_attempt_at,
+    DROP COLUMN IF EXISTS last_error,
+    DROP COLUMN IF EXISTS attempts;
+
+COMMIT;
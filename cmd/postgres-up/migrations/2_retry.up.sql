@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE outbox_messages
+    ADD COLUMN IF NOT EXISTS attempts integer NOT NULL DEFAULT 0, -- number of attempts to send the message
+    ADD COLUMN IF NOT EXISTS last_error text, -- error of the last failed attempt
+    ADD COLUMN IF NOT EXISTS next_attempt_at timestamp with time zone; -- when the message can be sent again
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+UPDATE outbox_messages SET status = 'undelivered', next_attempt_at = NULL WHERE status = 'dead';
+
+ALTER TABLE outbox_messages DROP CONSTRAINT IF EXISTS outbox_messages_status_check;
+ALTER TABLE outbox_messages ADD CONSTRAINT outbox_messages_status_check
+    CHECK (status IN ('undelivered', 'claimed', 'delivered'));
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS outbox_messages_pending_key_idx;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Supports looking up older undelivered messages with the same key when messages are ordered by key.
+CREATE INDEX IF NOT EXISTS outbox_messages_pending_key_idx ON outbox_messages (topic, key, created_at, id)
+    WHERE status IN ('undelivered', 'claimed');
+
+COMMIT;
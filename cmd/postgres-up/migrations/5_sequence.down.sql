@@ -0,0 +1,12 @@
+BEGIN;
+
+DROP INDEX IF EXISTS outbox_messages_pending_key_idx;
+CREATE INDEX IF NOT EXISTS outbox_messages_pending_key_idx ON outbox_messages (topic, key, created_at, id)
+    WHERE status IN ('undelivered', 'claimed');
+
+DROP INDEX IF EXISTS outbox_messages_pending_idx;
+
+ALTER TABLE outbox_messages DROP COLUMN IF EXISTS xid;
+ALTER TABLE outbox_messages DROP COLUMN IF EXISTS seq;
+
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+
+-- seq orders messages within a transaction, xid orders transactions.
+-- Existing messages keep their order by created_at and id.
+ALTER TABLE outbox_messages ADD COLUMN seq bigint;
+CREATE SEQUENCE outbox_messages_seq_seq OWNED BY outbox_messages.seq;
+UPDATE outbox_messages m
+SET seq = o.seq
+FROM (SELECT id, row_number() OVER (ORDER BY created_at, id) AS seq FROM outbox_messages) o
+WHERE m.id = o.id;
+SELECT setval('outbox_messages_seq_seq', COALESCE(MAX(seq), 0) + 1, false) FROM outbox_messages;
+ALTER TABLE outbox_messages
+    ALTER COLUMN seq SET DEFAULT nextval('outbox_messages_seq_seq'),
+    ALTER COLUMN seq SET NOT NULL;
+
+ALTER TABLE outbox_messages ADD COLUMN xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+CREATE INDEX IF NOT EXISTS outbox_messages_pending_idx ON outbox_messages (xid, seq)
+    WHERE status IN ('undelivered', 'claimed');
+
+DROP INDEX IF EXISTS outbox_messages_pending_key_idx;
+CREATE INDEX IF NOT EXISTS outbox_messages_pending_key_idx ON outbox_messages (topic, key, xid, seq)
+    WHERE status IN ('undelivered', 'claimed');
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP TABLE IF EXISTS outbox_retention_counts;
+DROP TABLE IF EXISTS outbox_messages_archive;
+DROP INDEX IF EXISTS outbox_messages_settled_idx;
+
+COMMIT;
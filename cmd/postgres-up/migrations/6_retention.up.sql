@@ -0,0 +1,26 @@
+BEGIN;
+
+CREATE INDEX IF NOT EXISTS outbox_messages_settled_idx ON outbox_messages (status, created_at)
+    WHERE status IN ('delivered', 'dead');
+
+-- Rows removed from outbox_messages by retention when archiving is enabled.
+-- The whole row is kept as JSON so that the archive doesn't have to follow changes of outbox_messages.
+CREATE TABLE IF NOT EXISTS outbox_messages_archive (
+    id uuid NOT NULL,
+    status text NOT NULL,
+    created_at timestamp with time zone,
+    archived_at timestamp with time zone NOT NULL DEFAULT now(),
+    message jsonb NOT NULL,
+
+    PRIMARY KEY (id)
+);
+
+-- Number of rows removed from outbox_messages by retention, by status.
+CREATE TABLE IF NOT EXISTS outbox_retention_counts (
+    status text NOT NULL,
+    removed_count bigint NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (status)
+);
+
+COMMIT;
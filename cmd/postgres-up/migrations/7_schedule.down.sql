@@ -0,0 +1,13 @@
+BEGIN;
+
+UPDATE outbox_messages SET status = 'undelivered' WHERE status = 'scheduled';
+
+DROP INDEX IF EXISTS outbox_messages_scheduled_idx;
+
+ALTER TABLE outbox_messages DROP CONSTRAINT IF EXISTS outbox_messages_status_check;
+ALTER TABLE outbox_messages ADD CONSTRAINT outbox_messages_status_check
+    CHECK (status IN ('undelivered', 'claimed', 'delivered', 'dead'));
+
+ALTER TABLE outbox_messages DROP COLUMN IF EXISTS deliver_after;
+
+COMMIT;
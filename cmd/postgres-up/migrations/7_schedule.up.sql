@@ -0,0 +1,13 @@
+BEGIN;
+
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS deliver_after timestamp with time zone;
+
+ALTER TABLE outbox_messages DROP CONSTRAINT IF EXISTS outbox_messages_status_check;
+ALTER TABLE outbox_messages ADD CONSTRAINT outbox_messages_status_check
+    CHECK (status IN ('scheduled', 'undelivered', 'claimed', 'delivered', 'dead'));
+
+-- Supports finding scheduled messages whose time has come without scanning the ones scheduled later.
+CREATE INDEX IF NOT EXISTS outbox_messages_scheduled_idx ON outbox_messages (deliver_after)
+    WHERE status = 'scheduled';
+
+COMMIT;
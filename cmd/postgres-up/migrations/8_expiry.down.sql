@@ -0,0 +1,18 @@
+BEGIN;
+
+-- Expired messages must not be sent after all, so they become dead rather than undelivered.
+UPDATE outbox_messages SET status = 'dead' WHERE status = 'expired';
+
+DROP INDEX IF EXISTS outbox_messages_settled_idx;
+CREATE INDEX IF NOT EXISTS outbox_messages_settled_idx ON outbox_messages (status, created_at)
+    WHERE status IN ('delivered', 'dead');
+
+DROP INDEX IF EXISTS outbox_messages_expiring_idx;
+
+ALTER TABLE outbox_messages DROP CONSTRAINT IF EXISTS outbox_messages_status_check;
+ALTER TABLE outbox_messages ADD CONSTRAINT outbox_messages_status_check
+    CHECK (status IN ('scheduled', 'undelivered', 'claimed', 'delivered', 'dead'));
+
+ALTER TABLE outbox_messages DROP COLUMN IF EXISTS expires_at;
+
+COMMIT;
@@ -0,0 +1,17 @@
+BEGIN;
+
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone;
+
+ALTER TABLE outbox_messages DROP CONSTRAINT IF EXISTS outbox_messages_status_check;
+ALTER TABLE outbox_messages ADD CONSTRAINT outbox_messages_status_check
+    CHECK (status IN ('scheduled', 'undelivered', 'claimed', 'delivered', 'dead', 'expired'));
+
+-- Supports finding messages that expired before they were sent.
+CREATE INDEX IF NOT EXISTS outbox_messages_expiring_idx ON outbox_messages (expires_at)
+    WHERE status IN ('scheduled', 'undelivered', 'claimed') AND expires_at IS NOT NULL;
+
+DROP INDEX IF EXISTS outbox_messages_settled_idx;
+CREATE INDEX IF NOT EXISTS outbox_messages_settled_idx ON outbox_messages (status, created_at)
+    WHERE status IN ('delivered', 'dead', 'expired');
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE outbox_messages DROP COLUMN IF EXISTS priority;
+
+COMMIT;
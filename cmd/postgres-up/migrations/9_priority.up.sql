@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS priority integer NOT NULL DEFAULT 0;
+
+COMMIT;
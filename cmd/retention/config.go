@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/caarlos0/env/v11"
+	"github.com/k11v/outbox/internal/partition"
+	"github.com/k11v/outbox/internal/postgresutil"
+	"github.com/k11v/outbox/internal/retention"
+)
+
+// config holds the application configuration.
+type config struct {
+	Development bool                `env:"OUTBOX_DEVELOPMENT"`
+	Partition   partition.Config    `envPrefix:"OUTBOX_PARTITION_"`
+	Postgres    postgresutil.Config `envPrefix:"OUTBOX_POSTGRES_"`
+	Retention   retention.Config    `envPrefix:"OUTBOX_RETENTION_"`
+}
+
+// parseConfig parses the application configuration from the environment variables.
+func parseConfig(environ []string) (config, error) {
+	cfg := config{}
+
+	err := env.ParseWithOptions(&cfg, env.Options{
+		Environment: env.ToMap(environ),
+	})
+	if err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/k11v/outbox/internal/partition"
+	"github.com/k11v/outbox/internal/postgresutil"
+	"github.com/k11v/outbox/internal/retention"
+)
+
+func main() {
+	if err := run(os.Stdout, os.Environ()); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func run(stdout io.Writer, environ []string) error {
+	cfg, err := parseConfig(environ)
+	if err != nil {
+		return err
+	}
+	log := newLogger(stdout, cfg.Development)
+
+	ctx := context.Background()
+
+	postgresPool, err := postgresutil.NewPool(ctx, log, cfg.Postgres, cfg.Development)
+	if err != nil {
+		return err
+	}
+	defer postgresPool.Close()
+
+	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(runCtx, func() {
+		log.Info("shutting down")
+	})
+
+	log.Info(
+		"starting retention",
+		"development", cfg.Development,
+		"archive", cfg.Retention.Archive,
+		"partition", cfg.Partition.Enabled,
+	)
+	var wg sync.WaitGroup
+	if cfg.Partition.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			partition.NewMaintainer(cfg.Partition, log, postgresPool).Run(runCtx)
+		}()
+	}
+	retention.NewCleaner(cfg.Retention, log, postgresPool).Run(runCtx)
+	wg.Wait()
+
+	return nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/caarlos0/env/v11"
-	"github.com/k11v/outbox/internal/kafkautil"
 	"github.com/k11v/outbox/internal/postgresutil"
 	"github.com/k11v/outbox/internal/server"
 )
@@ -10,7 +9,6 @@ import (
 // config holds the application configuration.
 type config struct {
 	Development bool                `env:"OUTBOX_DEVELOPMENT"`
-	Kafka       kafkautil.Config    `envPrefix:"OUTBOX_KAFKA_"`
 	Postgres    postgresutil.Config `envPrefix:"OUTBOX_POSTGRES_"`
 	Server      server.Config       `envPrefix:"OUTBOX_SERVER_"`
 }
@@ -5,11 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"os"
 
-	"github.com/k11v/outbox/internal/kafkautil"
 	"github.com/k11v/outbox/internal/postgresutil"
 	"github.com/k11v/outbox/internal/server"
 )
@@ -31,16 +29,13 @@ func run(stdout io.Writer, environ []string) error {
 
 	ctx := context.Background()
 
-	kafkaWriter := kafkautil.NewWriter(cfg.Kafka)
-	defer closeWithLog(kafkaWriter, log)
-
 	postgresPool, err := postgresutil.NewPool(ctx, log, cfg.Postgres, cfg.Development)
 	if err != nil {
 		return err
 	}
 	defer postgresPool.Close()
 
-	srv := server.New(cfg.Server, log, kafkaWriter, postgresPool)
+	srv := server.New(cfg.Server, log, postgresPool)
 	lst, err := server.Listen(cfg.Server)
 	if err != nil {
 		return err
@@ -58,9 +53,3 @@ func run(stdout io.Writer, environ []string) error {
 
 	return nil
 }
-
-func closeWithLog(c io.Closer, log *slog.Logger) {
-	if err := c.Close(); err != nil {
-		log.Error("failed to close", "error", err)
-	}
-}
@@ -2,16 +2,30 @@ package main
 
 import (
 	"github.com/caarlos0/env/v11"
+	"github.com/k11v/outbox/internal/amqputil"
+	"github.com/k11v/outbox/internal/jsonl"
 	"github.com/k11v/outbox/internal/kafkautil"
+	"github.com/k11v/outbox/internal/natsutil"
+	"github.com/k11v/outbox/internal/partition"
 	"github.com/k11v/outbox/internal/postgresutil"
+	"github.com/k11v/outbox/internal/redisutil"
+	"github.com/k11v/outbox/internal/retention"
+	"github.com/k11v/outbox/internal/webhook"
 	"github.com/k11v/outbox/internal/worker"
 )
 
 // config holds the application configuration.
 type config struct {
+	AMQP        amqputil.Config     `envPrefix:"OUTBOX_AMQP_"`
 	Development bool                `env:"OUTBOX_DEVELOPMENT"`
+	JSONL       jsonl.Config        `envPrefix:"OUTBOX_JSONL_"`
 	Kafka       kafkautil.Config    `envPrefix:"OUTBOX_KAFKA_"`
+	NATS        natsutil.Config     `envPrefix:"OUTBOX_NATS_"`
+	Partition   partition.Config    `envPrefix:"OUTBOX_PARTITION_"`
 	Postgres    postgresutil.Config `envPrefix:"OUTBOX_POSTGRES_"`
+	Redis       redisutil.Config    `envPrefix:"OUTBOX_REDIS_"`
+	Retention   retention.Config    `envPrefix:"OUTBOX_RETENTION_"`
+	Webhook     webhook.Config      `envPrefix:"OUTBOX_WEBHOOK_"`
 	Worker      worker.Config       `envPrefix:"OUTBOX_WORKER_"`
 }
 
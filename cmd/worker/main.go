@@ -7,32 +7,45 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/k11v/outbox/internal/amqputil"
+	"github.com/k11v/outbox/internal/jsonl"
 	"github.com/k11v/outbox/internal/kafkautil"
+	"github.com/k11v/outbox/internal/natsutil"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/partition"
 	"github.com/k11v/outbox/internal/postgresutil"
+	"github.com/k11v/outbox/internal/redisutil"
+	"github.com/k11v/outbox/internal/retention"
+	"github.com/k11v/outbox/internal/webhook"
 	"github.com/k11v/outbox/internal/worker"
 )
 
 func main() {
-	if err := run(os.Stdout, os.Environ()); err != nil {
+	if err := run(os.Stdout, os.Stderr, os.Environ()); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 	os.Exit(0)
 }
 
-func run(stdout io.Writer, environ []string) error {
+func run(stdout io.Writer, stderr io.Writer, environ []string) error {
 	cfg, err := parseConfig(environ)
 	if err != nil {
 		return err
 	}
-	log := newLogger(stdout, cfg.Development)
+	log := newLogger(logWriter(cfg, stdout, stderr), cfg.Development)
 
 	ctx := context.Background()
 
-	kafkaWriter := kafkautil.NewWriter(cfg.Kafka)
-	defer closeWithLog(kafkaWriter, log)
+	publisher, err := newPublisher(cfg, log, stdout)
+	if err != nil {
+		return err
+	}
+	defer closeWithLog(publisher, log)
 
 	postgresPool, err := postgresutil.NewPool(ctx, log, cfg.Postgres, cfg.Development)
 	if err != nil {
@@ -40,26 +53,152 @@ func run(stdout io.Writer, environ []string) error {
 	}
 	defer postgresPool.Close()
 
-	w := worker.NewWorker(cfg.Worker, log, kafkaWriter, postgresPool)
+	w, err := worker.NewWorker(cfg.Worker, log, publisher, postgresPool)
+	if err != nil {
+		return err
+	}
 
-	done := make(chan struct{})
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-		<-sig
+	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(runCtx, func() {
 		log.Info("shutting down")
-		close(done)
-	}()
+	})
 
 	log.Info(
 		"starting worker",
 		"development", cfg.Development,
+		"amqp", cfg.AMQP.Enabled,
+		"cdc", cfg.Worker.CDC.Enabled,
+		"jsonl", cfg.JSONL.Enabled,
+		"leader_election", cfg.Worker.LeaderElection.Enabled,
+		"listen", cfg.Worker.Listen,
+		"nats", cfg.NATS.Enabled,
+		"partition", cfg.Partition.Enabled,
+		"retention", cfg.Retention.Enabled,
+		"ordering", cfg.Worker.Ordering,
+		"priority", cfg.Worker.Priority.Enabled,
+		"redis", cfg.Redis.Enabled,
+		"webhook", cfg.Webhook.Enabled,
 	)
-	w.Run(done)
+	var wg sync.WaitGroup
+	if cfg.Retention.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retention.NewCleaner(cfg.Retention, log, postgresPool).Run(runCtx)
+		}()
+	}
+	if cfg.Partition.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			partition.NewMaintainer(cfg.Partition, log, postgresPool).Run(runCtx)
+		}()
+	}
+	w.Run(runCtx)
+	wg.Wait()
+	log.Info("stopped worker")
 
 	return nil
 }
 
+// logWriter returns the writer that logs are written to.
+// Logs go to stderr when messages are written to stdout as JSON lines, so that stdout has nothing but the messages.
+func logWriter(cfg config, stdout io.Writer, stderr io.Writer) io.Writer {
+	if cfg.JSONL.Enabled && cfg.JSONL.Path == "" {
+		return stderr
+	}
+	return stdout
+}
+
+// newPublisher returns the publisher that the worker sends messages with.
+// Messages are sent to Kafka unless their topics are sent elsewhere. JetStream, AMQP, Redis and JSONL take the topics
+// they are configured with, or replace Kafka if they are configured without topics. Webhooks take the topics of their
+// endpoints.
+func newPublisher(cfg config, log *slog.Logger, stdout io.Writer) (publisher outbox.Publisher, err error) {
+	var replacing []string
+	if cfg.NATS.Enabled && len(cfg.NATS.Topics) == 0 {
+		replacing = append(replacing, "nats")
+	}
+	if cfg.AMQP.Enabled && len(cfg.AMQP.Topics) == 0 {
+		replacing = append(replacing, "amqp")
+	}
+	if cfg.Redis.Enabled && len(cfg.Redis.Topics) == 0 {
+		replacing = append(replacing, "redis")
+	}
+	if cfg.JSONL.Enabled && len(cfg.JSONL.Topics) == 0 {
+		replacing = append(replacing, "jsonl")
+	}
+	if len(replacing) > 1 {
+		return nil, fmt.Errorf(
+			"only one of %s can replace kafka, set the topics of the others",
+			strings.Join(replacing, ", "),
+		)
+	}
+
+	// The publishers that were created are closed if a later one fails.
+	var created []outbox.Publisher
+	defer func() {
+		if err != nil {
+			for _, p := range created {
+				closeWithLog(p, log)
+			}
+		}
+	}()
+
+	var natsPublisher *natsutil.Publisher
+	if cfg.NATS.Enabled {
+		if natsPublisher, err = natsutil.NewPublisher(cfg.NATS); err != nil {
+			return nil, err
+		}
+		created = append(created, natsPublisher)
+	}
+	var redisPublisher *redisutil.Publisher
+	if cfg.Redis.Enabled {
+		if redisPublisher, err = redisutil.NewPublisher(cfg.Redis); err != nil {
+			return nil, err
+		}
+		created = append(created, redisPublisher)
+	}
+	var webhookPublisher *webhook.Publisher
+	if cfg.Webhook.Enabled {
+		if webhookPublisher, err = webhook.NewPublisher(cfg.Webhook, log); err != nil {
+			return nil, err
+		}
+		created = append(created, webhookPublisher)
+	}
+
+	var router *outbox.Router
+	switch {
+	case cfg.NATS.Enabled && len(cfg.NATS.Topics) == 0:
+		router = outbox.NewRouter(natsPublisher)
+	case cfg.AMQP.Enabled && len(cfg.AMQP.Topics) == 0:
+		router = outbox.NewRouter(amqputil.NewPublisher(cfg.AMQP))
+	case cfg.Redis.Enabled && len(cfg.Redis.Topics) == 0:
+		router = outbox.NewRouter(redisPublisher)
+	case cfg.JSONL.Enabled && len(cfg.JSONL.Topics) == 0:
+		router = outbox.NewRouter(jsonl.NewPublisher(cfg.JSONL, stdout))
+	default:
+		router = outbox.NewRouter(kafkautil.NewPublisher(cfg.Kafka))
+	}
+	if cfg.NATS.Enabled && len(cfg.NATS.Topics) > 0 {
+		router.Route(natsPublisher, cfg.NATS.Topics...)
+	}
+	if cfg.AMQP.Enabled && len(cfg.AMQP.Topics) > 0 {
+		router.Route(amqputil.NewPublisher(cfg.AMQP), cfg.AMQP.Topics...)
+	}
+	if cfg.Redis.Enabled && len(cfg.Redis.Topics) > 0 {
+		router.Route(redisPublisher, cfg.Redis.Topics...)
+	}
+	if cfg.JSONL.Enabled && len(cfg.JSONL.Topics) > 0 {
+		router.Route(jsonl.NewPublisher(cfg.JSONL, stdout), cfg.JSONL.Topics...)
+	}
+	if cfg.Webhook.Enabled {
+		router.Route(webhookPublisher, cfg.Webhook.Topics()...)
+	}
+	return router, nil
+}
+
 func closeWithLog(c io.Closer, log *slog.Logger) {
 	if err := c.Close(); err != nil {
 		log.Error("failed to close", "error", err)
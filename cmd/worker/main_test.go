@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/k11v/outbox/internal/jsonl"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+func TestJSONLStdout(t *testing.T) {
+	t.Run("Writes messages to stdout and logs to stderr", func(t *testing.T) {
+		cfg, err := parseConfig([]string{
+			"OUTBOX_JSONL_ENABLED=true",
+			"OUTBOX_KAFKA_BROKERS=localhost:9094",
+			"OUTBOX_POSTGRES_DSN=postgres://localhost:5432/postgres",
+		})
+		if err != nil {
+			t.Fatalf("failed to parse config: %v", err)
+		}
+		var stdout, stderr bytes.Buffer
+		log := newLogger(logWriter(cfg, &stdout, &stderr), cfg.Development)
+
+		publisher, err := newPublisher(cfg, log, &stdout)
+		if err != nil {
+			t.Fatalf("failed to create publisher: %v", err)
+		}
+		defer closeWithLog(publisher, log)
+		log.Info("starting worker")
+		errs := publisher.Publish(context.Background(), []outbox.Message{{ID: "a", Topic: "example"}})
+		if errs[0] != nil {
+			t.Fatalf("got %v error, want nil", errs[0])
+		}
+
+		want := `{"id":"a","topic":"example","key":"","value":"","headers":[]}` + "\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("got %q stdout, want %q", got, want)
+		}
+		if got := stderr.String(); !strings.Contains(got, "starting worker") {
+			t.Errorf("got %q stderr, want it to contain the log", got)
+		}
+	})
+
+	t.Run("Writes logs to stdout when messages are written to a file", func(t *testing.T) {
+		cfg := config{JSONL: jsonl.Config{Enabled: true, Path: "outbox.jsonl"}}
+		var stdout, stderr bytes.Buffer
+
+		if got := logWriter(cfg, &stdout, &stderr); got != &stdout {
+			t.Errorf("got logs written to stderr, want stdout")
+		}
+	})
+}
@@ -0,0 +1,360 @@
+// Package amqputil publishes outbox messages to AMQP 0-9-1 brokers such as RabbitMQ.
+package amqputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/k11v/outbox/internal/outbox"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// notifyBuffer is the size of the buffers of the channels that receive returns and confirmations.
+const notifyBuffer = 128
+
+// Publisher publishes messages to AMQP exchanges with publisher confirms.
+// It should be created with NewPublisher.
+type Publisher struct {
+	cfg Config
+
+	mu          sync.Mutex // guards the connection and the channel, and serializes publishing
+	amqpConn    *amqp.Connection
+	amqpChannel *amqp.Channel
+	confirmer   *confirmer
+	exchanges   map[string]bool // exchanges known to exist
+}
+
+// NewPublisher creates a new Publisher.
+// It connects to the broker on the first publish and reconnects after the connection or the channel is closed.
+// It is the caller's responsibility to close the publisher when done.
+func NewPublisher(cfg Config) *Publisher {
+	return &Publisher{cfg: cfg}
+}
+
+// Publish publishes messages to the exchanges and with the routing keys made from their topics and keys, and waits
+// until the broker confirms them. Messages are published as mandatory and persistent, so a message that no queue
+// receives fails instead of being dropped. It returns the error of each message, which is nil for messages that the
+// broker confirmed.
+func (p *Publisher) Publish(ctx context.Context, msgs []outbox.Message) []error {
+	errs := make([]error, len(msgs))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.timeout())
+	defer cancel()
+
+	if err := p.open(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	exchanges := make([]string, len(msgs))
+	for i, m := range msgs {
+		exchanges[i] = expand(p.cfg.exchange(), m.Topic, m.Key)
+	}
+	exchangeErrs := p.checkExchanges(exchanges)
+
+	// Publishing is serialized, so the next sequence number is the delivery tag of the message.
+	results := make([]<-chan error, len(msgs))
+	for i, m := range msgs {
+		if err := exchangeErrs[exchanges[i]]; err != nil {
+			errs[i] = err
+			continue
+		}
+		publishing := newPublishing(m)
+		tag := p.amqpChannel.GetNextPublishSeqNo()
+		results[i] = p.confirmer.add(tag, publishing.MessageId)
+		err := p.amqpChannel.PublishWithContext(
+			ctx,
+			exchanges[i],
+			expand(p.cfg.routingKey(), m.Topic, m.Key),
+			true,
+			false,
+			publishing,
+		)
+		if err != nil {
+			p.confirmer.remove(tag)
+			results[i] = nil
+			errs[i] = fmt.Errorf("failed to publish message: %w", err)
+		}
+	}
+
+	aborted := false
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		select {
+		case errs[i] = <-result:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			aborted = true
+		}
+	}
+
+	// A broker that doesn't confirm in time is likely unhealthy, so the connection is reopened.
+	if aborted || p.amqpChannel.IsClosed() {
+		_ = p.close()
+	}
+	return errs
+}
+
+// checkExchanges checks that the exchanges exist, because the broker closes the channel when a message is published
+// to a missing exchange, which would fail the messages published after it.
+// It returns the error of each exchange that doesn't exist or couldn't be checked. Exchanges that exist are remembered
+// until the connection is closed.
+func (p *Publisher) checkExchanges(names []string) map[string]error {
+	errs := make(map[string]error)
+
+	// The broker closes the channel of a failed check too, so the checks use their own channel.
+	var checkChannel *amqp.Channel
+	defer func() {
+		if checkChannel != nil {
+			_ = checkChannel.Close()
+		}
+	}()
+
+	for _, name := range names {
+		// The default exchange always exists.
+		if name == "" || p.exchanges[name] || errs[name] != nil {
+			continue
+		}
+		if checkChannel == nil || checkChannel.IsClosed() {
+			var err error
+			checkChannel, err = p.amqpConn.Channel()
+			if err != nil {
+				errs[name] = fmt.Errorf("failed to open amqp channel: %w", err)
+				continue
+			}
+		}
+
+		err := checkChannel.ExchangeDeclarePassive(name, amqp.ExchangeDirect, false, false, false, false, nil)
+		var amqpErr *amqp.Error
+		switch {
+		case errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound:
+			errs[name] = fmt.Errorf("exchange %q doesn't exist", name)
+		case err != nil:
+			errs[name] = fmt.Errorf("failed to check exchange %q: %w", name, err)
+		default:
+			p.exchanges[name] = true
+		}
+	}
+	return errs
+}
+
+// Close closes the connection to the broker.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.close()
+}
+
+// open connects to the broker and opens a channel in confirm mode unless they are already open.
+func (p *Publisher) open() error {
+	if p.amqpChannel != nil && !p.amqpChannel.IsClosed() {
+		return nil
+	}
+	_ = p.close()
+
+	amqpConn, err := amqp.Dial(p.cfg.url())
+	if err != nil {
+		return fmt.Errorf("failed to connect to amqp broker: %w", err)
+	}
+	amqpChannel, err := amqpConn.Channel()
+	if err != nil {
+		_ = amqpConn.Close()
+		return fmt.Errorf("failed to open amqp channel: %w", err)
+	}
+	if err = amqpChannel.Confirm(false); err != nil {
+		_ = amqpConn.Close()
+		return fmt.Errorf("failed to put amqp channel into confirm mode: %w", err)
+	}
+
+	p.amqpConn = amqpConn
+	p.amqpChannel = amqpChannel
+	p.exchanges = make(map[string]bool)
+	p.confirmer = newConfirmer(
+		amqpChannel.NotifyReturn(make(chan amqp.Return, notifyBuffer)),
+		amqpChannel.NotifyPublish(make(chan amqp.Confirmation, notifyBuffer)),
+	)
+	return nil
+}
+
+// close closes the connection to the broker, if any, with its channel.
+func (p *Publisher) close() error {
+	if p.amqpConn == nil {
+		return nil
+	}
+	err := p.amqpConn.Close()
+	p.amqpConn, p.amqpChannel, p.confirmer, p.exchanges = nil, nil, nil, nil
+	if errors.Is(err, amqp.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// errChannelClosed is the result of messages whose channel was closed before the broker confirmed them.
+var errChannelClosed = errors.New("amqp channel was closed before the message was confirmed")
+
+// confirmer matches the returns and the confirmations of a channel to the messages published on it.
+// It receives them in its own goroutine for as long as the channel is open, so the client never waits to pass them
+// on, even when no one is publishing.
+type confirmer struct {
+	mu      sync.Mutex // guards the fields below
+	pending map[uint64]*pendingMessage
+	byID    map[string]*pendingMessage
+	closed  bool
+}
+
+// pendingMessage is a message that was published and waits for its confirmation.
+type pendingMessage struct {
+	tag      uint64
+	id       string
+	returned error
+	result   chan error // buffered, receives the result once
+}
+
+// newConfirmer creates a new confirmer that receives returns and confirmations until both channels are closed.
+func newConfirmer(returns <-chan amqp.Return, confirmations <-chan amqp.Confirmation) *confirmer {
+	c := &confirmer{
+		pending: make(map[uint64]*pendingMessage),
+		byID:    make(map[string]*pendingMessage),
+	}
+	go c.run(returns, confirmations)
+	return c
+}
+
+// add adds a message that is about to be published with the delivery tag and the message ID.
+// It returns the channel that receives the result of the message, which is nil if the broker confirmed it.
+func (c *confirmer) add(tag uint64, id string) <-chan error {
+	m := &pendingMessage{tag: tag, id: id, result: make(chan error, 1)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		m.result <- errChannelClosed
+		return m.result
+	}
+	c.pending[tag] = m
+	c.byID[id] = m
+	return m.result
+}
+
+// remove removes a message that failed to be published.
+func (c *confirmer) remove(tag uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m, ok := c.pending[tag]; ok {
+		c.delete(m)
+	}
+}
+
+func (c *confirmer) run(returns <-chan amqp.Return, confirmations <-chan amqp.Confirmation) {
+	for returns != nil || confirmations != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.handleReturn(r)
+		case confirmation, ok := <-confirmations:
+			if !ok {
+				confirmations = nil
+				c.close()
+				continue
+			}
+			// The broker returns an unroutable message before it confirms the message, and the client passes them on
+			// in that order, so the returns that came before the confirmation are handled first.
+			for drained := false; !drained; {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						continue
+					}
+					c.handleReturn(r)
+				default:
+					drained = true
+				}
+			}
+			c.handleConfirmation(confirmation)
+		}
+	}
+}
+
+func (c *confirmer) handleReturn(r amqp.Return) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m, ok := c.byID[r.MessageId]; ok && m.returned == nil {
+		m.returned = fmt.Errorf("message was returned: %d %s", r.ReplyCode, r.ReplyText)
+	}
+}
+
+func (c *confirmer) handleConfirmation(confirmation amqp.Confirmation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.pending[confirmation.DeliveryTag]
+	if !ok {
+		return
+	}
+	c.delete(m)
+
+	switch {
+	case m.returned != nil:
+		m.result <- m.returned
+	case !confirmation.Ack:
+		m.result <- errors.New("message was not confirmed")
+	default:
+		m.result <- nil
+	}
+}
+
+// close fails the pending messages, because the channel was closed and they won't be confirmed.
+func (c *confirmer) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.pending {
+		m.result <- errChannelClosed
+	}
+	c.pending, c.byID = nil, nil
+	c.closed = true
+}
+
+// delete deletes a pending message. The caller must hold c.mu.
+func (c *confirmer) delete(m *pendingMessage) {
+	delete(c.pending, m.tag)
+	if c.byID[m.id] == m {
+		delete(c.byID, m.id)
+	}
+}
+
+// newPublishing maps a message to an AMQP publishing.
+// Headers become AMQP headers, and the ID and the time become the message ID and the timestamp properties. A message
+// without an ID gets a random one, so that it can be told apart when the broker returns it.
+func newPublishing(m outbox.Message) amqp.Publishing {
+	publishing := amqp.Publishing{
+		Headers:      make(amqp.Table, len(m.Headers)),
+		DeliveryMode: amqp.Persistent,
+		MessageId:    m.ID,
+		Timestamp:    m.Time,
+		Body:         m.Value,
+	}
+	for _, h := range m.Headers {
+		publishing.Headers[h.Key] = string(h.Value)
+		if strings.EqualFold(h.Key, "Content-Type") {
+			publishing.ContentType = string(h.Value)
+		}
+	}
+	if publishing.MessageId == "" {
+		publishing.MessageId = uuid.NewString()
+	}
+	return publishing
+}
@@ -0,0 +1,269 @@
+package amqputil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/k11v/outbox/internal/outbox"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// urlEnv is the environment variable that holds the URL of an AMQP broker such as a local RabbitMQ.
+// Tests that need a broker are skipped when it is unset.
+const urlEnv = "OUTBOX_TEST_AMQP_URL"
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "{topic}", want: "orders"},
+		{template: "{key}", want: "a-key"},
+		{template: "events", want: "events"},
+		{template: "{topic}.{key}", want: "orders.a-key"},
+	}
+
+	for _, tt := range tests {
+		t.Run("Expands "+tt.template, func(t *testing.T) {
+			if got := expand(tt.template, "orders", []byte("a-key")); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPublishing(t *testing.T) {
+	t.Run("Maps messages to AMQP publishings", func(t *testing.T) {
+		msgTime := time.Date(2024, 7, 10, 12, 30, 45, 0, time.UTC)
+
+		got := newPublishing(outbox.Message{
+			ID:      "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+			Topic:   "orders",
+			Key:     []byte("a-key"),
+			Value:   []byte("a-value"),
+			Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+			Time:    msgTime,
+		})
+
+		want := amqp.Publishing{
+			Headers:      amqp.Table{"Content-Type": "application/json"},
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+			Timestamp:    msgTime,
+			Body:         []byte("a-value"),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("Gives messages without an ID a random one", func(t *testing.T) {
+		got := newPublishing(outbox.Message{Topic: "orders"})
+
+		if _, err := uuid.Parse(got.MessageId); err != nil {
+			t.Errorf("got %q message ID, want a UUID", got.MessageId)
+		}
+	})
+}
+
+func TestConfirmer(t *testing.T) {
+	t.Run("Fails returned messages even if they are confirmed together", func(t *testing.T) {
+		returns := make(chan amqp.Return, 1)
+		confirmations := make(chan amqp.Confirmation, 2)
+		c := &confirmer{pending: make(map[uint64]*pendingMessage), byID: make(map[string]*pendingMessage)}
+		resultA := c.add(1, "a")
+		resultB := c.add(2, "b")
+		returns <- amqp.Return{MessageId: "b", ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE"}
+		confirmations <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+		confirmations <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+		go c.run(returns, confirmations)
+
+		if err := receiveResult(t, resultA); err != nil {
+			t.Errorf("got %v error for confirmed message, want nil", err)
+		}
+		if err := receiveResult(t, resultB); err == nil {
+			t.Errorf("got nil error for returned message, want non-nil")
+		}
+	})
+
+	t.Run("Fails messages that weren't confirmed", func(t *testing.T) {
+		confirmations := make(chan amqp.Confirmation, 1)
+		c := newConfirmer(make(chan amqp.Return), confirmations)
+		result := c.add(1, "a")
+		confirmations <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+
+		if err := receiveResult(t, result); err == nil {
+			t.Errorf("got nil error, want non-nil")
+		}
+	})
+
+	t.Run("Fails pending messages when the channel is closed", func(t *testing.T) {
+		returns := make(chan amqp.Return)
+		confirmations := make(chan amqp.Confirmation)
+		c := newConfirmer(returns, confirmations)
+		result := c.add(1, "a")
+		close(returns)
+		close(confirmations)
+
+		if err := receiveResult(t, result); !errors.Is(err, errChannelClosed) {
+			t.Errorf("got %v error, want %v", err, errChannelClosed)
+		}
+		if err := receiveResult(t, c.add(2, "b")); !errors.Is(err, errChannelClosed) {
+			t.Errorf("got %v error after close, want %v", err, errChannelClosed)
+		}
+	})
+
+	t.Run("Receives returns while nothing is pending", func(t *testing.T) {
+		returns := make(chan amqp.Return)
+		newConfirmer(returns, make(chan amqp.Confirmation))
+
+		for i := 0; i < 2*notifyBuffer; i++ {
+			select {
+			case returns <- amqp.Return{MessageId: "unknown"}:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got return %d not received, want received", i)
+			}
+		}
+	})
+}
+
+func TestPublish(t *testing.T) {
+	t.Run("Publishes confirmed messages to the exchanges of their topics", func(t *testing.T) {
+		p, deliveries := newTestPublisher(t, Config{})
+
+		errs := p.Publish(context.Background(), []outbox.Message{
+			{ID: "a", Topic: exchangeName(t), Key: []byte("a-key"), Value: []byte("a-value")},
+			{ID: "b", Topic: exchangeName(t), Key: []byte("b-key"), Value: []byte("b-value")},
+		})
+
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("got %v error for message %d, want nil", err, i)
+			}
+		}
+		for _, want := range []string{"a", "b"} {
+			select {
+			case d := <-deliveries:
+				if got := d.MessageId; got != want {
+					t.Errorf("got %q message ID, want %q", got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got no delivery, want %q", want)
+			}
+		}
+	})
+
+	t.Run("Fails messages that can't be routed", func(t *testing.T) {
+		p, _ := newTestPublisher(t, Config{RoutingKey: "{key}"})
+
+		errs := p.Publish(context.Background(), []outbox.Message{
+			{ID: "a", Topic: exchangeName(t), Key: []byte("a-key")},
+			{ID: "b", Topic: exchangeName(t), Key: []byte("unbound")},
+			{ID: "c", Topic: "missing", Key: []byte("a-key")},
+		})
+
+		for i, wantFailed := range []bool{false, true, true} {
+			if got := errs[i] != nil; got != wantFailed {
+				t.Errorf("got failed %v for message %d, want %v (error: %v)", got, i, wantFailed, errs[i])
+			}
+		}
+
+		errs = p.Publish(context.Background(), []outbox.Message{{ID: "d", Topic: exchangeName(t), Key: []byte("a-key")}})
+		if errs[0] != nil {
+			t.Errorf("got %v error after a failed publish, want nil", errs[0])
+		}
+	})
+
+	t.Run("Fails only the messages of missing exchanges", func(t *testing.T) {
+		p, deliveries := newTestPublisher(t, Config{})
+
+		errs := p.Publish(context.Background(), []outbox.Message{
+			{ID: "a", Topic: "missing", Key: []byte("a-key")},
+			{ID: "b", Topic: exchangeName(t), Key: []byte("a-key")},
+			{ID: "c", Topic: exchangeName(t), Key: []byte("b-key")},
+		})
+
+		for i, wantFailed := range []bool{true, false, false} {
+			if got := errs[i] != nil; got != wantFailed {
+				t.Errorf("got failed %v for message %d, want %v (error: %v)", got, i, wantFailed, errs[i])
+			}
+		}
+		for _, want := range []string{"b", "c"} {
+			select {
+			case d := <-deliveries:
+				if got := d.MessageId; got != want {
+					t.Errorf("got %q message ID, want %q", got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got no delivery, want %q", want)
+			}
+		}
+	})
+}
+
+// newTestPublisher declares a direct exchange named after the test with a queue bound with the keys a-key and b-key,
+// and returns a publisher and the deliveries of the queue.
+func newTestPublisher(t *testing.T, cfg Config) (*Publisher, <-chan amqp.Delivery) {
+	t.Helper()
+
+	url := os.Getenv(urlEnv)
+	if url == "" {
+		t.Skipf("%s is not set", urlEnv)
+	}
+
+	amqpConn, err := amqp.Dial(url)
+	if err != nil {
+		t.Fatalf("failed to connect to amqp broker: %v", err)
+	}
+	t.Cleanup(func() { _ = amqpConn.Close() })
+	amqpChannel, err := amqpConn.Channel()
+	if err != nil {
+		t.Fatalf("failed to open amqp channel: %v", err)
+	}
+
+	exchange := exchangeName(t)
+	if err = amqpChannel.ExchangeDeclare(exchange, amqp.ExchangeDirect, false, true, false, false, nil); err != nil {
+		t.Fatalf("failed to declare exchange: %v", err)
+	}
+	queue, err := amqpChannel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		t.Fatalf("failed to declare queue: %v", err)
+	}
+	for _, key := range []string{"a-key", "b-key"} {
+		if err = amqpChannel.QueueBind(queue.Name, key, exchange, false, nil); err != nil {
+			t.Fatalf("failed to bind queue: %v", err)
+		}
+	}
+	deliveries, err := amqpChannel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		t.Fatalf("failed to consume queue: %v", err)
+	}
+
+	cfg.URL = url
+	p := NewPublisher(cfg)
+	t.Cleanup(func() { _ = p.Close() })
+	return p, deliveries
+}
+
+func receiveResult(t *testing.T, result <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("got no result, want one")
+		return nil
+	}
+}
+
+func exchangeName(t *testing.T) string {
+	return "outbox-test." + strings.ReplaceAll(t.Name(), "/", ".")
+}
@@ -0,0 +1,45 @@
+package inbox
+
+import "time"
+
+// Config holds the inbox configuration.
+// The zero value is a valid configuration.
+type Config struct {
+	Consumer      string        `env:"CONSUMER"`       // default: "default", scopes processed messages
+	IDHeader      string        `env:"ID_HEADER"`      // default: "outbox-id"
+	RetryInterval time.Duration `env:"RETRY_INTERVAL"` // default: 1s
+	SkipNoID      bool          `env:"SKIP_NO_ID"`     // skip messages without the ID header instead of retrying them
+	Timeout       time.Duration `env:"TIMEOUT"`        // default: 10s
+}
+
+func (c Config) consumer() string {
+	n := c.Consumer
+	if n == "" {
+		n = "default"
+	}
+	return n
+}
+
+func (c Config) idHeader() string {
+	h := c.IDHeader
+	if h == "" {
+		h = "outbox-id"
+	}
+	return h
+}
+
+func (c Config) retryInterval() time.Duration {
+	i := c.RetryInterval
+	if i == 0 {
+		i = time.Second
+	}
+	return i
+}
+
+func (c Config) timeout() time.Duration {
+	t := c.Timeout
+	if t == 0 {
+		t = 10 * time.Second
+	}
+	return t
+}
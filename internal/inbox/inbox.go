@@ -0,0 +1,180 @@
+// Package inbox consumes messages from Kafka and processes each message once.
+package inbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/segmentio/kafka-go"
+)
+
+// Handler handles a message.
+// It should make its writes in tx, which also records that the message is processed, so that the writes are made
+// once even if the message is delivered again.
+type Handler func(ctx context.Context, tx pgx.Tx, msg kafka.Message) error
+
+// Inbox reads messages from Kafka and processes each of them once.
+// It should be created with NewInbox.
+type Inbox struct {
+	cfg          Config
+	log          *slog.Logger
+	kafkaReader  messageReader
+	postgresPool *pgxpool.Pool
+}
+
+// messageReader reads messages from Kafka and commits their offsets.
+// It is implemented by *kafka.Reader.
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// NewInbox creates a new Inbox.
+// The reader should be a member of a consumer group, see kafkautil.NewReader.
+func NewInbox(cfg Config, log *slog.Logger, kafkaReader *kafka.Reader, postgresPool *pgxpool.Pool) *Inbox {
+	return &Inbox{
+		cfg:          cfg,
+		log:          log.With("component", "inbox", "consumer", cfg.consumer()),
+		kafkaReader:  kafkaReader,
+		postgresPool: postgresPool,
+	}
+}
+
+// Run reads messages and handles them with handle until ctx is canceled.
+// Messages are handled one at a time in the order they are read. A message that fails to be processed is retried
+// every retry interval, and the messages after it wait, so that no message is skipped. A message without an ID can't
+// be processed once, so it fails too unless the configuration skips such messages.
+func (i *Inbox) Run(ctx context.Context, handle Handler) {
+	for {
+		msg, err := i.kafkaReader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			i.log.Error("failed to fetch message", "error", err)
+			if !i.wait(ctx) {
+				return
+			}
+			continue
+		}
+
+		for {
+			err = i.process(ctx, msg, handle)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			i.log.Error(
+				"failed to process message",
+				"topic", msg.Topic,
+				"partition", msg.Partition,
+				"offset", msg.Offset,
+				"error", err,
+			)
+			if !i.wait(ctx) {
+				return
+			}
+		}
+	}
+}
+
+// wait waits for the retry interval and reports whether ctx is still active.
+func (i *Inbox) wait(ctx context.Context) bool {
+	timer := time.NewTimer(i.cfg.retryInterval())
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// process handles msg unless it is already processed and then commits its offset.
+// The message is recorded in inbox_messages in the same transaction as the writes of the handler, and the offset is
+// committed only after the transaction commits. If the offset fails to be committed, the message is read again and
+// skipped because it is recorded. A message without an ID fails, or if the configuration skips such messages, isn't
+// handled and has its offset committed right away.
+func (i *Inbox) process(ctx context.Context, msg kafka.Message, handle Handler) error {
+	id, ok := i.messageID(msg)
+	if !ok && !i.cfg.SkipNoID {
+		return fmt.Errorf("message has no %s header", i.cfg.idHeader())
+	}
+	if !ok {
+		i.log.Error(
+			"skipped message without ID",
+			"header", i.cfg.idHeader(),
+			"topic", msg.Topic,
+			"partition", msg.Partition,
+			"offset", msg.Offset,
+		)
+		if err := i.kafkaReader.CommitMessages(ctx, msg); err != nil {
+			return fmt.Errorf("failed to commit offset: %w", err)
+		}
+		return nil
+	}
+
+	txCtx, cancel := context.WithTimeout(ctx, i.cfg.timeout())
+	defer cancel()
+
+	tx, err := i.postgresPool.Begin(txCtx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func(tx pgx.Tx) {
+		_ = tx.Rollback(txCtx)
+	}(tx)
+
+	// Record the message. A consumer that processes the same message concurrently waits here until this transaction
+	// ends.
+
+	tag, err := tx.Exec(
+		txCtx,
+		`
+			INSERT INTO inbox_messages (consumer, message_id, topic, partition, "offset")
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (consumer, message_id) DO NOTHING
+		`,
+		i.cfg.consumer(),
+		id,
+		msg.Topic,
+		msg.Partition,
+		msg.Offset,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert into inbox_messages: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		i.log.Debug("skipped processed message", "message_id", id, "topic", msg.Topic, "offset", msg.Offset)
+	} else {
+		if err = handle(txCtx, tx, msg); err != nil {
+			return fmt.Errorf("failed to handle message: %w", err)
+		}
+		if err = tx.Commit(txCtx); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	if err = i.kafkaReader.CommitMessages(ctx, msg); err != nil {
+		return fmt.Errorf("failed to commit offset: %w", err)
+	}
+	return nil
+}
+
+// messageID returns the ID of msg from the ID header and reports whether msg has one.
+func (i *Inbox) messageID(msg kafka.Message) (string, bool) {
+	for _, h := range msg.Headers {
+		if h.Key == i.cfg.idHeader() && len(h.Value) > 0 {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,168 @@
+package inbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestRun(t *testing.T) {
+	t.Run("Handles each message once and commits every offset", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		kafkaReader := &fakeReader{messages: []kafka.Message{
+			newMessage("id-a", 0),
+			newMessage("id-b", 1),
+			newMessage("id-a", 2), // redelivered by the producer
+		}}
+
+		var handled []string
+		runInbox(t, Config{}, pool, kafkaReader, 3, func(_ context.Context, _ pgx.Tx, msg kafka.Message) error {
+			handled = append(handled, string(msg.Headers[0].Value))
+			return nil
+		})
+
+		if got, want := fmt.Sprint(handled), fmt.Sprint([]string{"id-a", "id-b"}); got != want {
+			t.Errorf("got %v handled, want %v", got, want)
+		}
+		if got, want := countInboxMessages(t, pool), 2; got != want {
+			t.Errorf("got %d inbox messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Rolls back and retries a message that fails to be handled", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		kafkaReader := &fakeReader{messages: []kafka.Message{newMessage("id-a", 0)}}
+
+		attempts := 0
+		runInbox(t, Config{}, pool, kafkaReader, 1, func(ctx context.Context, tx pgx.Tx, _ kafka.Message) error {
+			attempts++
+			if _, err := tx.Exec(ctx, `INSERT INTO inbox_messages VALUES ('other', 'id-x', 'example', 0, 0)`); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+
+		if got, want := attempts, 2; got != want {
+			t.Errorf("got %d attempts, want %d", got, want)
+		}
+		if got, want := countInboxMessages(t, pool), 2; got != want {
+			t.Errorf("got %d inbox messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Doesn't commit offsets of messages without an ID", func(t *testing.T) {
+		kafkaReader := &fakeReader{messages: []kafka.Message{{Topic: "example"}}}
+
+		runInbox(t, Config{}, nil, kafkaReader, 0, func(context.Context, pgx.Tx, kafka.Message) error {
+			t.Errorf("got message handled, want none")
+			return nil
+		})
+	})
+
+	t.Run("Skips and commits the offsets of messages without an ID if configured to", func(t *testing.T) {
+		kafkaReader := &fakeReader{messages: []kafka.Message{
+			{Topic: "example", Offset: 0},
+			{Topic: "example", Offset: 1, Headers: []kafka.Header{{Key: "outbox-id"}}},
+		}}
+
+		runInbox(t, Config{SkipNoID: true}, nil, kafkaReader, 2, func(context.Context, pgx.Tx, kafka.Message) error {
+			t.Errorf("got message handled, want none")
+			return nil
+		})
+	})
+}
+
+// runInbox runs an inbox until kafkaReader has the number of commits, or for a while if it is 0.
+func runInbox(t *testing.T, cfg Config, pool *pgxpool.Pool, kafkaReader *fakeReader, commits int, handle Handler) {
+	t.Helper()
+
+	cfg.RetryInterval = time.Millisecond
+	i := NewInbox(cfg, slog.Default(), nil, pool)
+	i.kafkaReader = kafkaReader
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		i.Run(ctx, handle)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	if commits == 0 {
+		deadline = time.Now().Add(100 * time.Millisecond)
+	}
+	for time.Now().Before(deadline) && (commits == 0 || kafkaReader.commitCount() < commits) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if got, want := kafkaReader.commitCount(), commits; got != want {
+		t.Errorf("got %d commits, want %d", got, want)
+	}
+}
+
+func newMessage(id string, offset int64) kafka.Message {
+	return kafka.Message{
+		Topic:   "example",
+		Offset:  offset,
+		Headers: []kafka.Header{{Key: "outbox-id", Value: []byte(id)}},
+		Value:   []byte("value"),
+	}
+}
+
+func countInboxMessages(t *testing.T, pool *pgxpool.Pool) int {
+	t.Helper()
+
+	var count int
+	if err := pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM inbox_messages`).Scan(&count); err != nil {
+		t.Fatalf("failed to count inbox messages: %v", err)
+	}
+	return count
+}
+
+// fakeReader returns messages in order and then blocks until ctx is canceled.
+type fakeReader struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	commits  []kafka.Message
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	if len(r.messages) > 0 {
+		m := r.messages[0]
+		r.messages = r.messages[1:]
+		r.mu.Unlock()
+		return m, nil
+	}
+	r.mu.Unlock()
+
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commits = append(r.commits, msgs...)
+	return nil
+}
+
+func (r *fakeReader) commitCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.commits)
+}
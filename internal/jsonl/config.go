@@ -0,0 +1,19 @@
+package jsonl
+
+// Config holds JSONL configuration.
+// The zero value is a valid configuration.
+type Config struct {
+	Enabled  bool     `env:"ENABLED"`                 // write messages as JSON lines
+	MaxBytes int64    `env:"MAX_BYTES"`               // rotates the file before it grows over this size, 0 means never
+	MaxFiles int      `env:"MAX_FILES"`               // default: 5, rotated files that are kept
+	Path     string   `env:"PATH"`                    // default: stdout
+	Topics   []string `env:"TOPICS" envSeparator:","` // default: every topic
+}
+
+func (c Config) maxFiles() int {
+	n := c.MaxFiles
+	if n == 0 {
+		n = 5
+	}
+	return n
+}
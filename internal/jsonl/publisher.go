@@ -0,0 +1,199 @@
+// Package jsonl writes outbox messages as JSON lines to a file or to stdout.
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// Publisher writes messages as JSON lines.
+// It should be created with NewPublisher.
+type Publisher struct {
+	cfg    Config
+	stdout io.Writer
+
+	mu   sync.Mutex // guards the file and serializes writing
+	file *os.File
+	size int64 // of the file
+}
+
+// NewPublisher creates a new Publisher.
+// It writes to the file at the configured path, or to stdout if the path is empty. The file is opened on the first
+// publish and is rotated by size: the file becomes path.1, path.1 becomes path.2 and so on up to the maximum number of
+// rotated files, and the oldest one is removed.
+// It is the caller's responsibility to close the publisher when done.
+func NewPublisher(cfg Config, stdout io.Writer) *Publisher {
+	return &Publisher{cfg: cfg, stdout: stdout}
+}
+
+// Publish writes each message as a line and syncs the file.
+// The lines are written in the order of the messages, one write per line. It returns the error of each message, which
+// is nil for messages that were written.
+func (p *Publisher) Publish(ctx context.Context, msgs []outbox.Message) []error {
+	errs := make([]error, len(msgs))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, m := range msgs {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		b, err := marshalLine(m)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = p.write(b)
+	}
+
+	if p.file != nil {
+		if err := p.file.Sync(); err != nil {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = fmt.Errorf("failed to sync file: %w", err)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// Close closes the file, if any.
+// Stdout isn't closed.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.close()
+}
+
+// write writes b to stdout or to the file, rotating the file first if b would make it too big.
+func (p *Publisher) write(b []byte) error {
+	if p.cfg.Path == "" {
+		if _, err := p.stdout.Write(b); err != nil {
+			return fmt.Errorf("failed to write to stdout: %w", err)
+		}
+		return nil
+	}
+
+	if p.file == nil {
+		if err := p.open(); err != nil {
+			return err
+		}
+	}
+	if p.cfg.MaxBytes > 0 && p.size > 0 && p.size+int64(len(b)) > p.cfg.MaxBytes {
+		if err := p.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := p.file.Write(b)
+	p.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+	return nil
+}
+
+// open opens the file for appending, creating it if it doesn't exist.
+func (p *Publisher) open() error {
+	file, err := os.OpenFile(p.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	p.file = file
+	p.size = info.Size()
+	return nil
+}
+
+// rotate closes the file, shifts it and the rotated files by one and opens a new file.
+func (p *Publisher) rotate() error {
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := p.close(); err != nil {
+		return err
+	}
+
+	for n := p.cfg.maxFiles() - 1; n >= 1; n-- {
+		err := os.Rename(rotatedPath(p.cfg.Path, n), rotatedPath(p.cfg.Path, n+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rename rotated file: %w", err)
+		}
+	}
+	if err := os.Rename(p.cfg.Path, rotatedPath(p.cfg.Path, 1)); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return p.open()
+}
+
+// close closes the file, if any.
+func (p *Publisher) close() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file, p.size = nil, 0
+	if err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return nil
+}
+
+func rotatedPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// line is the schema of a line.
+// Fields may be added but are never renamed or removed. The key, the value and the headers are strings like in the
+// create message request, and the time isn't included, so that the lines of the same messages are the same.
+type line struct {
+	ID      string       `json:"id"`
+	Topic   string       `json:"topic"`
+	Key     string       `json:"key"`
+	Value   string       `json:"value"`
+	Headers []lineHeader `json:"headers"`
+}
+
+type lineHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// marshalLine returns the line of a message with the trailing newline.
+func marshalLine(m outbox.Message) ([]byte, error) {
+	l := line{
+		ID:      m.ID,
+		Topic:   m.Topic,
+		Key:     string(m.Key),
+		Value:   string(m.Value),
+		Headers: make([]lineHeader, len(m.Headers)),
+	}
+	for i, h := range m.Headers {
+		l.Headers[i] = lineHeader{Key: h.Key, Value: string(h.Value)}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(l); err != nil {
+		return nil, fmt.Errorf("failed to marshal line: %w", err)
+	}
+	return buf.Bytes(), nil
+}
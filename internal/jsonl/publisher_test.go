@@ -0,0 +1,99 @@
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+func TestPublish(t *testing.T) {
+	t.Run("Writes messages as lines to stdout", func(t *testing.T) {
+		var stdout bytes.Buffer
+		p := NewPublisher(Config{}, &stdout)
+
+		errs := p.Publish(context.Background(), []outbox.Message{
+			{
+				ID:      "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+				Topic:   "orders",
+				Key:     []byte("a-key"),
+				Value:   []byte(`{"total":"<10&"}`),
+				Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+			},
+			{ID: "b", Topic: "payments"},
+		})
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("got %v error for message %d, want nil", err, i)
+			}
+		}
+
+		got := stdout.String()
+		want := `{"id":"5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10","topic":"orders","key":"a-key",` +
+			`"value":"{\"total\":\"<10&\"}","headers":[{"key":"Content-Type","value":"application/json"}]}` + "\n" +
+			`{"id":"b","topic":"payments","key":"","value":"","headers":[]}` + "\n"
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if err := p.Close(); err != nil {
+			t.Errorf("got %v close error, want nil", err)
+		}
+	})
+
+	t.Run("Appends lines to the file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "outbox.jsonl")
+		if err := os.WriteFile(path, []byte("existing\n"), 0o644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		p := NewPublisher(Config{Path: path}, nil)
+		t.Cleanup(func() { _ = p.Close() })
+
+		if errs := p.Publish(context.Background(), []outbox.Message{{ID: "a", Topic: "orders"}}); errs[0] != nil {
+			t.Fatalf("got %v error, want nil", errs[0])
+		}
+
+		got := readFile(t, path)
+		want := "existing\n" + `{"id":"a","topic":"orders","key":"","value":"","headers":[]}` + "\n"
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Rotates the file before it grows over the max size", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "outbox.jsonl")
+		lineA := `{"id":"a","topic":"orders","key":"","value":"","headers":[]}` + "\n"
+		p := NewPublisher(Config{Path: path, MaxBytes: int64(2 * len(lineA)), MaxFiles: 2}, nil)
+		t.Cleanup(func() { _ = p.Close() })
+
+		for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			if errs := p.Publish(context.Background(), []outbox.Message{{ID: id, Topic: "orders"}}); errs[0] != nil {
+				t.Fatalf("got %v error for message %s, want nil", errs[0], id)
+			}
+		}
+
+		for name, ids := range map[string]string{path + ".2": "cd", path + ".1": "ef", path: "g"} {
+			want := ""
+			for _, id := range ids {
+				want += `{"id":"` + string(id) + `","topic":"orders","key":"","value":"","headers":[]}` + "\n"
+			}
+			if got := readFile(t, name); got != want {
+				t.Errorf("got %q in %s, want %q", got, filepath.Base(name), want)
+			}
+		}
+		if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+			t.Errorf("got %v stat error for the third rotated file, want not exist", err)
+		}
+	})
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	return string(b)
+}
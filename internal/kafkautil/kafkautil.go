@@ -13,3 +13,14 @@ func NewWriter(cfg Config) *kafka.Writer {
 		RequiredAcks: kafka.RequireOne,
 	}
 }
+
+// NewReader creates a new kafka.Reader that reads topics as a member of the consumer group.
+// Offsets are committed only when the caller commits messages.
+// It is the caller's responsibility to close the reader when done.
+func NewReader(cfg Config, groupID string, topics []string) *kafka.Reader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     cfg.Brokers,
+		GroupID:     groupID,
+		GroupTopics: topics,
+	})
+}
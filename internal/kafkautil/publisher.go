@@ -0,0 +1,133 @@
+package kafkautil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher publishes messages to Kafka.
+// It should be created with NewPublisher.
+type Publisher struct {
+	kafkaWriter messageWriter
+}
+
+// messageWriter writes messages to Kafka.
+// It is implemented by *kafka.Writer.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// NewPublisher creates a new Publisher.
+// It is the caller's responsibility to close the publisher when done.
+func NewPublisher(cfg Config) *Publisher {
+	return &Publisher{kafkaWriter: NewWriter(cfg)}
+}
+
+// Publish writes messages to Kafka.
+// It returns the error of each message, which is nil for messages that were written.
+func (p *Publisher) Publish(ctx context.Context, msgs []outbox.Message) []error {
+	kafkaMessages := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		kafkaMessages[i] = newKafkaMessage(m)
+	}
+	return p.write(ctx, kafkaMessages)
+}
+
+// Close closes the underlying writer.
+func (p *Publisher) Close() error {
+	return p.kafkaWriter.Close()
+}
+
+// newKafkaMessage maps a message to a Kafka message.
+func newKafkaMessage(m outbox.Message) kafka.Message {
+	headers := make([]kafka.Header, len(m.Headers))
+	for i, h := range m.Headers {
+		headers[i] = kafka.Header{Key: h.Key, Value: h.Value}
+	}
+	return kafka.Message{
+		Topic:   m.Topic,
+		Key:     m.Key,
+		Value:   m.Value,
+		Headers: headers,
+		Time:    m.Time,
+	}
+}
+
+// write writes Kafka messages and returns the error of each message.
+// Kafka reports errors of individual messages only after the messages are assigned to partitions. When the whole
+// write fails before that, e.g. because a topic doesn't exist or a message is too large, the messages are written again
+// without the failed ones so that one bad message doesn't fail the others.
+func (p *Publisher) write(ctx context.Context, msgs []kafka.Message) []error {
+	errs := make([]error, len(msgs))
+
+	err := p.kafkaWriter.WriteMessages(ctx, msgs...)
+	if err == nil {
+		return errs
+	}
+
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) && len(writeErrs) == len(msgs) {
+		copy(errs, writeErrs)
+		return errs
+	}
+
+	if ctx.Err() != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	var tooLargeErr kafka.MessageTooLargeError
+	if errors.As(err, &tooLargeErr) {
+		if i := indexOfMessage(msgs, tooLargeErr.Message); i >= 0 {
+			restErrs := p.write(ctx, tooLargeErr.Remaining)
+			copy(errs[:i], restErrs[:i])
+			errs[i] = err
+			copy(errs[i+1:], restErrs[i:])
+			return errs
+		}
+	}
+
+	topicIndexes := make(map[string][]int)
+	var topics []string
+	for i, m := range msgs {
+		if _, ok := topicIndexes[m.Topic]; !ok {
+			topics = append(topics, m.Topic)
+		}
+		topicIndexes[m.Topic] = append(topicIndexes[m.Topic], i)
+	}
+	if len(topics) == 1 {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for _, topic := range topics {
+		indexes := topicIndexes[topic]
+		topicMsgs := make([]kafka.Message, len(indexes))
+		for j, i := range indexes {
+			topicMsgs[j] = msgs[i]
+		}
+		for j, topicErr := range p.write(ctx, topicMsgs) {
+			errs[indexes[j]] = topicErr
+		}
+	}
+	return errs
+}
+
+// indexOfMessage returns the index of the first message in msgs with the same topic, key and value as m, or -1.
+func indexOfMessage(msgs []kafka.Message, m kafka.Message) int {
+	for i, candidate := range msgs {
+		if candidate.Topic == m.Topic && bytes.Equal(candidate.Key, m.Key) && bytes.Equal(candidate.Value, m.Value) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,144 @@
+package kafkautil
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestPublish(t *testing.T) {
+	tests := []struct {
+		name        string
+		kafkaWriter *fakeWriter
+		msgs        []outbox.Message
+		wantFailed  []bool
+	}{
+		{
+			name:        "Writes all messages",
+			kafkaWriter: &fakeWriter{},
+			msgs:        []outbox.Message{{Topic: "a"}, {Topic: "b"}},
+			wantFailed:  []bool{false, false},
+		},
+		{
+			name:        "Isolates messages with unknown topic",
+			kafkaWriter: &fakeWriter{unknownTopics: map[string]bool{"missing": true}},
+			msgs:        []outbox.Message{{Topic: "a"}, {Topic: "missing"}, {Topic: "b"}, {Topic: "missing"}},
+			wantFailed:  []bool{false, true, false, true},
+		},
+		{
+			name:        "Isolates messages that are too large",
+			kafkaWriter: &fakeWriter{maxValueSize: 3},
+			msgs:        []outbox.Message{{Value: []byte("a")}, {Value: []byte("large")}, {Value: []byte("b")}},
+			wantFailed:  []bool{false, true, false},
+		},
+		{
+			name: "Uses errors of individual messages",
+			kafkaWriter: &fakeWriter{fail: func(m kafka.Message) error {
+				if string(m.Key) == "bad" {
+					return kafka.NotEnoughReplicas
+				}
+				return nil
+			}},
+			msgs:       []outbox.Message{{Key: []byte("good")}, {Key: []byte("bad")}},
+			wantFailed: []bool{false, true},
+		},
+		{
+			name:        "Fails all messages when writer fails",
+			kafkaWriter: &fakeWriter{err: errors.New("broker is unavailable")},
+			msgs:        []outbox.Message{{Topic: "a"}, {Topic: "a"}},
+			wantFailed:  []bool{true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Publisher{kafkaWriter: tt.kafkaWriter}
+
+			errs := p.Publish(context.Background(), tt.msgs)
+
+			if got, want := len(errs), len(tt.msgs); got != want {
+				t.Fatalf("got %d errors, want %d", got, want)
+			}
+			for i, err := range errs {
+				if got, want := err != nil, tt.wantFailed[i]; got != want {
+					t.Errorf("got failed %v for message %d, want %v (error: %v)", got, i, want, err)
+				}
+			}
+		})
+	}
+
+	t.Run("Maps messages to Kafka messages", func(t *testing.T) {
+		kafkaWriter := &fakeWriter{}
+		p := &Publisher{kafkaWriter: kafkaWriter}
+		msgTime := time.Date(2024, 7, 10, 12, 30, 45, 0, time.UTC)
+
+		p.Publish(context.Background(), []outbox.Message{{
+			Topic:   "example",
+			Key:     []byte("a-key"),
+			Value:   []byte("a-value"),
+			Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+			Time:    msgTime,
+		}})
+
+		want := []kafka.Message{{
+			Topic:   "example",
+			Key:     []byte("a-key"),
+			Value:   []byte("a-value"),
+			Headers: []kafka.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+			Time:    msgTime,
+		}}
+		if got := kafkaWriter.written; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+}
+
+// fakeWriter is a messageWriter that records written messages.
+// It fails like kafka.Writer: with a plain error if a topic is unknown or a message is too large, and with
+// kafka.WriteErrors if some messages fail.
+type fakeWriter struct {
+	err           error                     // returned for every write
+	unknownTopics map[string]bool           // fail the whole write
+	maxValueSize  int                       // fails the whole write when exceeded, 0 means unlimited
+	fail          func(kafka.Message) error // fails individual messages
+
+	written []kafka.Message
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	for i, m := range msgs {
+		if w.unknownTopics[m.Topic] {
+			return kafka.UnknownTopicOrPartition
+		}
+		if w.maxValueSize > 0 && len(m.Value) > w.maxValueSize {
+			remaining := append(append([]kafka.Message(nil), msgs[:i]...), msgs[i+1:]...)
+			return kafka.MessageTooLargeError{Message: m, Remaining: remaining}
+		}
+	}
+
+	errs := make(kafka.WriteErrors, len(msgs))
+	for i, m := range msgs {
+		if w.fail != nil {
+			errs[i] = w.fail(m)
+		}
+		if errs[i] == nil {
+			w.written = append(w.written, m)
+		}
+	}
+	if errs.Count() > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	return nil
+}
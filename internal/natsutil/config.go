@@ -0,0 +1,38 @@
+package natsutil
+
+import "time"
+
+// Config holds NATS configuration.
+// The zero value is a valid configuration.
+type Config struct {
+	Enabled       bool          `env:"ENABLED"`                 // send messages to JetStream
+	KeyHeader     string        `env:"KEY_HEADER"`              // default: "outbox-key"
+	SubjectPrefix string        `env:"SUBJECT_PREFIX"`          // prepended to topics to make subjects
+	Timeout       time.Duration `env:"TIMEOUT"`                 // default: 10s, to wait for acknowledgements
+	Topics        []string      `env:"TOPICS" envSeparator:","` // default: every topic
+	URL           string        `env:"URL"`                     // default: "nats://127.0.0.1:4222"
+}
+
+func (c Config) keyHeader() string {
+	h := c.KeyHeader
+	if h == "" {
+		h = "outbox-key"
+	}
+	return h
+}
+
+func (c Config) timeout() time.Duration {
+	t := c.Timeout
+	if t == 0 {
+		t = 10 * time.Second
+	}
+	return t
+}
+
+func (c Config) url() string {
+	u := c.URL
+	if u == "" {
+		u = "nats://127.0.0.1:4222"
+	}
+	return u
+}
@@ -0,0 +1,88 @@
+// Package natsutil publishes outbox messages to NATS JetStream.
+package natsutil
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Publisher publishes messages to JetStream.
+// It should be created with NewPublisher.
+type Publisher struct {
+	cfg       Config
+	natsConn  *nats.Conn
+	jetStream jetstream.JetStream
+}
+
+// NewPublisher connects to NATS and creates a new Publisher.
+// It is the caller's responsibility to close the publisher when done.
+func NewPublisher(cfg Config) (*Publisher, error) {
+	natsConn, err := nats.Connect(cfg.url(), nats.Name("outbox"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	jetStream, err := jetstream.New(natsConn)
+	if err != nil {
+		natsConn.Close()
+		return nil, fmt.Errorf("failed to create jetstream: %w", err)
+	}
+	return &Publisher{cfg: cfg, natsConn: natsConn, jetStream: jetStream}, nil
+}
+
+// Publish publishes messages to the subjects of their topics and waits until JetStream acknowledges them.
+// The subject of a message is its topic with the subject prefix, so a stream must capture the subject. The ID of a
+// message is sent in the Nats-Msg-Id header, so JetStream drops a message that is sent again within the duplicate
+// window of the stream. It returns the error of each message, which is nil for messages that were acknowledged,
+// including the dropped duplicates.
+func (p *Publisher) Publish(ctx context.Context, msgs []outbox.Message) []error {
+	errs := make([]error, len(msgs))
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.timeout())
+	defer cancel()
+
+	futures := make([]jetstream.PubAckFuture, len(msgs))
+	for i, m := range msgs {
+		var opts []jetstream.PublishOpt
+		if m.ID != "" {
+			opts = append(opts, jetstream.WithMsgID(m.ID))
+		}
+		futures[i], errs[i] = p.jetStream.PublishMsgAsync(p.newNATSMessage(m), opts...)
+	}
+
+	for i, f := range futures {
+		if f == nil {
+			continue
+		}
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			errs[i] = err
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+	return errs
+}
+
+// Close drains the connection to NATS.
+func (p *Publisher) Close() error {
+	return p.natsConn.Drain()
+}
+
+// newNATSMessage maps a message to a NATS message.
+// NATS messages have no key, so the key is sent in the key header.
+func (p *Publisher) newNATSMessage(m outbox.Message) *nats.Msg {
+	natsMsg := nats.NewMsg(p.cfg.SubjectPrefix + m.Topic)
+	natsMsg.Data = m.Value
+	for _, h := range m.Headers {
+		natsMsg.Header.Add(h.Key, string(h.Value))
+	}
+	if len(m.Key) > 0 {
+		natsMsg.Header.Set(p.cfg.keyHeader(), string(m.Key))
+	}
+	return natsMsg
+}
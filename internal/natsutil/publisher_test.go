@@ -0,0 +1,118 @@
+package natsutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestPublish(t *testing.T) {
+	t.Run("Maps messages to NATS messages", func(t *testing.T) {
+		ctx := context.Background()
+		p, stream := newTestPublisher(t, Config{SubjectPrefix: "outbox."})
+
+		errs := p.Publish(ctx, []outbox.Message{{
+			ID:      "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+			Topic:   "orders",
+			Key:     []byte("a-key"),
+			Value:   []byte("a-value"),
+			Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+		}})
+		if errs[0] != nil {
+			t.Fatalf("got %v error, want nil", errs[0])
+		}
+
+		got, err := stream.GetMsg(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get message: %v", err)
+		}
+		if got, want := got.Subject, "outbox.orders"; got != want {
+			t.Errorf("got %q subject, want %q", got, want)
+		}
+		if got, want := string(got.Data), "a-value"; got != want {
+			t.Errorf("got %q data, want %q", got, want)
+		}
+		wantHeaders := map[string]string{
+			"Content-Type": "application/json",
+			"outbox-key":   "a-key",
+			"Nats-Msg-Id":  "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+		}
+		for key, want := range wantHeaders {
+			if got := got.Header.Get(key); got != want {
+				t.Errorf("got %q %s header, want %q", got, key, want)
+			}
+		}
+	})
+
+	t.Run("Deduplicates messages with the same ID", func(t *testing.T) {
+		ctx := context.Background()
+		p, stream := newTestPublisher(t, Config{})
+
+		for i := 0; i < 2; i++ {
+			errs := p.Publish(ctx, []outbox.Message{{ID: "a", Topic: "orders"}, {ID: "b", Topic: "orders"}})
+			for _, err := range errs {
+				if err != nil {
+					t.Fatalf("got %v error, want nil", err)
+				}
+			}
+		}
+
+		info, err := stream.Info(ctx)
+		if err != nil {
+			t.Fatalf("failed to get stream info: %v", err)
+		}
+		if got, want := info.State.Msgs, uint64(2); got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Isolates messages without a stream", func(t *testing.T) {
+		ctx := context.Background()
+		p, _ := newTestPublisher(t, Config{Timeout: 5 * time.Second})
+
+		errs := p.Publish(ctx, []outbox.Message{{ID: "a", Topic: "orders"}, {ID: "b", Topic: "missing"}})
+
+		if errs[0] != nil {
+			t.Errorf("got %v error, want nil", errs[0])
+		}
+		if errs[1] == nil {
+			t.Errorf("got nil error, want non-nil")
+		}
+	})
+}
+
+// newTestPublisher starts an embedded NATS server with JetStream and a stream that captures the orders topic, and
+// returns a publisher connected to it.
+func newTestPublisher(t *testing.T, cfg Config) (*Publisher, jetstream.Stream) {
+	t.Helper()
+
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %v", err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("got nats server not ready, want ready")
+	}
+
+	cfg.URL = srv.ClientURL()
+	p, err := NewPublisher(cfg)
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+
+	stream, err := p.jetStream.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:     "orders",
+		Subjects: []string{cfg.SubjectPrefix + "orders"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create stream: %v", err)
+	}
+	return p, stream
+}
@@ -1,6 +1,13 @@
 package outbox
 
 const (
+	StatusScheduled   = "scheduled" // waits for deliver_after, then becomes undelivered
 	StatusUndelivered = "undelivered"
+	StatusClaimed     = "claimed" // claimed by a worker with a lease, see claimed_by and claimed_until
 	StatusDelivered   = "delivered"
+	StatusDead        = "dead"    // ran out of attempts, see attempts and last_error
+	StatusExpired     = "expired" // wasn't sent before expires_at
 )
+
+// Channel is the Postgres notification channel that is notified when messages are added to the outbox.
+const Channel = "outbox_messages"
@@ -0,0 +1,32 @@
+package outbox
+
+import (
+	"context"
+	"time"
+)
+
+// Message is a message that is published to a message broker.
+type Message struct {
+	ID      string // the ID of the outbox message, for brokers that deduplicate messages
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers []Header
+	Time    time.Time // optional, the broker's default if zero
+}
+
+// Header is a header of a Message.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Publisher publishes messages to a message broker.
+type Publisher interface {
+	// Publish publishes msgs and returns the error of each message, which is nil for messages that were published.
+	// Messages that fail don't prevent the others from being published.
+	Publish(ctx context.Context, msgs []Message) []error
+
+	// Close releases the resources of the publisher.
+	Close() error
+}
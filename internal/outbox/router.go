@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Router is a Publisher that publishes the messages of some topics with other publishers.
+// It should be created with NewRouter.
+type Router struct {
+	fallback   Publisher
+	publishers map[string]Publisher
+}
+
+// NewRouter creates a new Router that publishes messages with fallback until publishers are added with Route.
+// If fallback is nil, messages of topics without a publisher fail.
+func NewRouter(fallback Publisher) *Router {
+	return &Router{fallback: fallback, publishers: make(map[string]Publisher)}
+}
+
+// Route makes the router publish the messages of topics with publisher.
+func (r *Router) Route(publisher Publisher, topics ...string) {
+	for _, t := range topics {
+		r.publishers[t] = publisher
+	}
+}
+
+// Publish splits msgs by publisher and publishes the parts concurrently.
+func (r *Router) Publish(ctx context.Context, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+
+	var publishers []Publisher
+	indexes := make(map[Publisher][]int)
+	for i, m := range msgs {
+		p := r.publisher(m.Topic)
+		if p == nil {
+			errs[i] = fmt.Errorf("no publisher for topic %q", m.Topic)
+			continue
+		}
+		if _, ok := indexes[p]; !ok {
+			publishers = append(publishers, p)
+		}
+		indexes[p] = append(indexes[p], i)
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range publishers {
+		wg.Add(1)
+		go func(p Publisher, indexes []int) {
+			defer wg.Done()
+			part := make([]Message, len(indexes))
+			for j, i := range indexes {
+				part[j] = msgs[i]
+			}
+			for j, err := range p.Publish(ctx, part) {
+				errs[indexes[j]] = err
+			}
+		}(p, indexes[p])
+	}
+	wg.Wait()
+	return errs
+}
+
+// Close closes every publisher of the router once.
+func (r *Router) Close() error {
+	var errs []error
+	closed := make(map[Publisher]bool)
+	for _, p := range append([]Publisher{r.fallback}, r.values()...) {
+		if p == nil || closed[p] {
+			continue
+		}
+		closed[p] = true
+		errs = append(errs, p.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Router) publisher(topic string) Publisher {
+	if p, ok := r.publishers[topic]; ok {
+		return p
+	}
+	return r.fallback
+}
+
+func (r *Router) values() []Publisher {
+	values := make([]Publisher, 0, len(r.publishers))
+	for _, p := range r.publishers {
+		values = append(values, p)
+	}
+	return values
+}
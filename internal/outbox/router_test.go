@@ -0,0 +1,100 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	t.Run("Publishes messages with the publishers of their topics", func(t *testing.T) {
+		fallback := &fakePublisher{}
+		webhook := &fakePublisher{err: errors.New("endpoint is unavailable")}
+		r := NewRouter(fallback)
+		r.Route(webhook, "orders", "payments")
+
+		errs := r.Publish(context.Background(), []Message{{Topic: "a"}, {Topic: "orders"}, {Topic: "b"}, {Topic: "payments"}})
+
+		for i, wantFailed := range []bool{false, true, false, true} {
+			if got := errs[i] != nil; got != wantFailed {
+				t.Errorf("got failed %v for message %d, want %v", got, i, wantFailed)
+			}
+		}
+		if got, want := fallback.topics(), []string{"a", "b"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := webhook.topics(), []string{"orders", "payments"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Fails messages of other topics without a fallback", func(t *testing.T) {
+		r := NewRouter(nil)
+		r.Route(&fakePublisher{}, "orders")
+
+		errs := r.Publish(context.Background(), []Message{{Topic: "orders"}, {Topic: "a"}})
+
+		if errs[0] != nil || errs[1] == nil {
+			t.Errorf("got %v errors, want only the second to be non-nil", errs)
+		}
+	})
+
+	t.Run("Closes every publisher once", func(t *testing.T) {
+		fallback := &fakePublisher{}
+		webhook := &fakePublisher{}
+		r := NewRouter(fallback)
+		r.Route(webhook, "orders")
+		r.Route(webhook, "payments")
+		r.Route(fallback, "a")
+
+		if err := r.Close(); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := fallback.closes, 1; got != want {
+			t.Errorf("got %d closes of fallback, want %d", got, want)
+		}
+		if got, want := webhook.closes, 1; got != want {
+			t.Errorf("got %d closes of routed publisher, want %d", got, want)
+		}
+	})
+}
+
+// fakePublisher is a Publisher that records the topics of published messages.
+type fakePublisher struct {
+	err error // fails every message
+
+	mu        sync.Mutex
+	published []Message
+	closes    int
+}
+
+func (p *fakePublisher) Publish(_ context.Context, msgs []Message) []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = p.err
+		p.published = append(p.published, m)
+	}
+	return errs
+}
+
+func (p *fakePublisher) Close() error {
+	p.closes++
+	return nil
+}
+
+func (p *fakePublisher) topics() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var topics []string
+	for _, m := range p.published {
+		topics = append(topics, m.Topic)
+	}
+	return topics
+}
@@ -0,0 +1,56 @@
+package partition
+
+import "time"
+
+// Config holds the partitioning configuration.
+// The zero value is a valid configuration.
+type Config struct {
+	Archive   bool          `env:"ARCHIVE"`    // archive messages of dropped partitions to outbox_messages_archive
+	Backfill  int           `env:"BACKFILL"`   // default: 7, number of past partitions created for existing messages
+	DropAfter time.Duration `env:"DROP_AFTER"` // drop partitions that ended this long ago, 0 means never
+	Enabled   bool          `env:"ENABLED"`
+	Interval  time.Duration `env:"INTERVAL"` // default: 1h, how often partitions are maintained
+	Period    time.Duration `env:"PERIOD"`   // default: 24h, time range of a partition
+	Premake   int           `env:"PREMAKE"`  // default: 3, number of future partitions
+	Timeout   time.Duration `env:"TIMEOUT"`  // default: 1m
+}
+
+func (c Config) backfill() int {
+	b := c.Backfill
+	if b == 0 {
+		b = 7
+	}
+	return b
+}
+
+func (c Config) interval() time.Duration {
+	i := c.Interval
+	if i == 0 {
+		i = time.Hour
+	}
+	return i
+}
+
+func (c Config) period() time.Duration {
+	p := c.Period
+	if p == 0 {
+		p = 24 * time.Hour
+	}
+	return p
+}
+
+func (c Config) premake() int {
+	p := c.Premake
+	if p == 0 {
+		p = 3
+	}
+	return p
+}
+
+func (c Config) timeout() time.Duration {
+	t := c.Timeout
+	if t == 0 {
+		t = time.Minute
+	}
+	return t
+}
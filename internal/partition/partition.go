@@ -0,0 +1,427 @@
+// Package partition maintains outbox_messages as a table range-partitioned by created_at.
+// Partitions are created ahead of time and, if enabled, dropped once all their messages are settled, which removes old
+// messages without the bloat caused by deleting rows.
+package partition
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// lockKey is the key of the advisory lock that serializes changes of partitions.
+const lockKey = 0x6f75747061727473 // "outparts" in ASCII
+
+// idLockKey is the first key of the advisory locks that serialize inserts of messages with the same ID. The second key
+// is the hash of the ID.
+const idLockKey = 0x6f757469 // "outi" in ASCII
+
+// DefaultPartition is the partition of messages outside of the ranges of other partitions.
+const DefaultPartition = "outbox_messages_default"
+
+// Setup converts outbox_messages into a table range-partitioned by created_at unless it already is.
+// Existing messages are copied into partitions that cover them, up to the configured number of past periods, and
+// partitions are created up to the configured number of future periods. Older messages go to the default partition.
+// outbox_messages is locked while it runs.
+//
+// The primary key of a partitioned table must include created_at, so the uniqueness of IDs is kept by a trigger that
+// rejects a message whose ID is already used with unique_violation.
+func Setup(ctx context.Context, conn *pgx.Conn, cfg Config) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func(tx pgx.Tx) {
+		_ = tx.Rollback(ctx)
+	}(tx)
+
+	if _, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(lockKey)); err != nil {
+		return fmt.Errorf("failed to lock partitions: %w", err)
+	}
+
+	partitioned, err := isPartitioned(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		return nil
+	}
+
+	if _, err = tx.Exec(ctx, `LOCK TABLE outbox_messages IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return fmt.Errorf("failed to lock outbox_messages: %w", err)
+	}
+
+	// Remember the sequence and the indexes of the table, which are moved to the partitioned table.
+
+	var seqName *string
+	err = tx.QueryRow(ctx, `SELECT pg_get_serial_sequence('outbox_messages', 'seq')`).Scan(&seqName)
+	if err != nil {
+		return fmt.Errorf("failed to query sequence: %w", err)
+	}
+	result, err := tx.Query(
+		ctx,
+		`SELECT pg_get_indexdef(indexrelid) FROM pg_index WHERE indrelid = 'outbox_messages'::regclass AND NOT indisprimary`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query indexes: %w", err)
+	}
+	indexDefs, err := pgx.CollectRows(result, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to collect rows: %w", err)
+	}
+
+	// Create the partitioned table and its partitions.
+
+	_, err = tx.Exec(ctx, `UPDATE outbox_messages SET created_at = now() WHERE created_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to update outbox_messages: %w", err)
+	}
+	var oldest *time.Time
+	if err = tx.QueryRow(ctx, `SELECT min(created_at) FROM outbox_messages`).Scan(&oldest); err != nil {
+		return fmt.Errorf("failed to query oldest message: %w", err)
+	}
+	for _, sql := range []string{
+		`ALTER TABLE outbox_messages RENAME TO outbox_messages_unpartitioned`,
+		`
+			CREATE TABLE outbox_messages (
+				LIKE outbox_messages_unpartitioned INCLUDING DEFAULTS INCLUDING CONSTRAINTS
+			) PARTITION BY RANGE (created_at)
+		`,
+		`ALTER TABLE outbox_messages ALTER COLUMN created_at SET NOT NULL`,
+		fmt.Sprintf(`CREATE TABLE %s PARTITION OF outbox_messages DEFAULT`, pgx.Identifier{DefaultPartition}.Sanitize()),
+	} {
+		if _, err = tx.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("failed to create partitioned outbox_messages: %w", err)
+		}
+	}
+	now := time.Now()
+	from := now.Add(-time.Duration(cfg.backfill()) * cfg.period())
+	if oldest != nil && oldest.After(from) {
+		from = *oldest
+	}
+	if _, err = createPartitions(ctx, tx, cfg, from, now); err != nil {
+		return err
+	}
+
+	// Move the messages, the sequence and the indexes.
+
+	statements := []string{`INSERT INTO outbox_messages SELECT * FROM outbox_messages_unpartitioned`}
+	if seqName != nil {
+		// pg_get_serial_sequence returns a quoted name.
+		statements = append(statements, fmt.Sprintf(`ALTER SEQUENCE %s OWNED BY outbox_messages.seq`, *seqName))
+	}
+	statements = append(
+		statements,
+		`DROP TABLE outbox_messages_unpartitioned`,
+		`ALTER TABLE outbox_messages ADD PRIMARY KEY (id, created_at)`,
+		fmt.Sprintf(
+			`
+				CREATE OR REPLACE FUNCTION outbox_messages_check_id() RETURNS trigger
+				LANGUAGE plpgsql
+				SET search_path FROM CURRENT
+				AS $$
+				BEGIN
+					PERFORM pg_advisory_xact_lock(%d, hashtext(NEW.id::text));
+					IF EXISTS (SELECT 1 FROM outbox_messages WHERE id = NEW.id) THEN
+						RAISE unique_violation USING MESSAGE = format('message ID %%s is already used', NEW.id);
+					END IF;
+					RETURN NEW;
+				END
+				$$
+			`,
+			idLockKey,
+		),
+		`
+			CREATE TRIGGER outbox_messages_check_id
+			BEFORE INSERT ON outbox_messages
+			FOR EACH ROW EXECUTE FUNCTION outbox_messages_check_id()
+		`,
+	)
+	statements = append(statements, indexDefs...)
+	for _, sql := range statements {
+		if _, err = tx.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("failed to move outbox_messages: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Maintainer creates future partitions of outbox_messages and drops old ones if enabled.
+// It should be created with NewMaintainer.
+type Maintainer struct {
+	cfg          Config
+	log          *slog.Logger
+	postgresPool *pgxpool.Pool
+}
+
+// NewMaintainer creates a new Maintainer.
+func NewMaintainer(cfg Config, log *slog.Logger, postgresPool *pgxpool.Pool) *Maintainer {
+	return &Maintainer{
+		cfg:          cfg,
+		log:          log.With("component", "partition"),
+		postgresPool: postgresPool,
+	}
+}
+
+// Run maintains partitions every interval until ctx is canceled.
+func (m *Maintainer) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.cfg.interval())
+	defer ticker.Stop()
+
+	for {
+		created, dropped, err := m.Maintain(ctx)
+		if err != nil && ctx.Err() == nil {
+			m.log.Error("failed to maintain partitions", "error", err)
+		}
+		if len(created) > 0 || len(dropped) > 0 {
+			m.log.Info("maintained partitions", "created", created, "dropped", dropped)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Maintain creates partitions up to the configured number of future periods. If the drop delay is set, it also drops
+// partitions that ended more than the drop delay ago and whose messages are all delivered, dead or expired. Messages of
+// dropped partitions are counted in outbox_retention_counts like removed messages, and archived if enabled.
+// It returns the names of the created and dropped partitions. Changes are made in one transaction, so it returns no
+// names if it fails.
+func (m *Maintainer) Maintain(ctx context.Context) (created []string, dropped []string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.timeout())
+	defer cancel()
+
+	tx, err := m.postgresPool.Begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func(tx pgx.Tx) {
+		_ = tx.Rollback(ctx)
+	}(tx)
+
+	if _, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(lockKey)); err != nil {
+		return nil, nil, fmt.Errorf("failed to lock partitions: %w", err)
+	}
+	partitioned, err := isPartitioned(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !partitioned {
+		return nil, nil, fmt.Errorf("outbox_messages isn't partitioned")
+	}
+
+	now := time.Now()
+	if created, err = createPartitions(ctx, tx, m.cfg, now, now); err != nil {
+		return nil, nil, err
+	}
+	if m.cfg.DropAfter > 0 {
+		if dropped, err = m.dropPartitions(ctx, tx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return created, dropped, nil
+}
+
+// dropPartitions drops partitions that ended more than the drop delay ago and whose messages are all settled.
+// Messages are never inserted into partitions that ended, so a partition whose messages are all settled stays that
+// way. It returns the names of the dropped partitions.
+func (m *Maintainer) dropPartitions(ctx context.Context, tx pgx.Tx) ([]string, error) {
+	result, err := tx.Query(
+		ctx,
+		`
+			SELECT c.relname
+			FROM pg_inherits i
+			JOIN pg_class c ON c.oid = i.inhrelid
+			WHERE i.inhparent = 'outbox_messages'::regclass
+				AND substring(pg_get_expr(c.relpartbound, c.oid) FROM 'TO \(''([^'']+)''\)')::timestamptz
+					<= now() - @dropAfterMilliseconds * interval '1 millisecond'
+			ORDER BY c.relname
+		`,
+		pgx.NamedArgs{"dropAfterMilliseconds": m.cfg.DropAfter.Milliseconds()},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query partitions: %w", err)
+	}
+	names, err := pgx.CollectRows(result, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect rows: %w", err)
+	}
+
+	var dropped []string
+	for _, name := range names {
+		var pending bool
+		err = tx.QueryRow(
+			ctx,
+			fmt.Sprintf(
+				`SELECT EXISTS (SELECT 1 FROM %s WHERE status NOT IN ($1, $2, $3))`,
+				pgx.Identifier{name}.Sanitize(),
+			),
+			outbox.StatusDelivered,
+			outbox.StatusDead,
+			outbox.StatusExpired,
+		).Scan(&pending)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query partition %s: %w", name, err)
+		}
+		if pending {
+			continue
+		}
+
+		// Count and archive the messages like retention does when it removes them.
+		_, err = tx.Exec(
+			ctx,
+			fmt.Sprintf(
+				`
+					WITH archived AS (
+						INSERT INTO outbox_messages_archive (id, status, created_at, message)
+						SELECT id, status, created_at, to_jsonb(p)
+						FROM %[1]s p
+						WHERE @archive
+					)
+					INSERT INTO outbox_retention_counts (status, removed_count)
+					SELECT status, COUNT(*)
+					FROM %[1]s
+					GROUP BY status
+					ON CONFLICT (status) DO UPDATE
+					SET removed_count = outbox_retention_counts.removed_count + excluded.removed_count
+				`,
+				pgx.Identifier{name}.Sanitize(),
+			),
+			pgx.NamedArgs{"archive": m.cfg.Archive},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count messages of partition %s: %w", name, err)
+		}
+
+		for _, sql := range []string{
+			fmt.Sprintf(`ALTER TABLE outbox_messages DETACH PARTITION %s`, pgx.Identifier{name}.Sanitize()),
+			fmt.Sprintf(`DROP TABLE %s`, pgx.Identifier{name}.Sanitize()),
+		} {
+			if _, err = tx.Exec(ctx, sql); err != nil {
+				return nil, fmt.Errorf("failed to drop partition %s: %w", name, err)
+			}
+		}
+		dropped = append(dropped, name)
+	}
+
+	return dropped, nil
+}
+
+// isPartitioned reports whether outbox_messages is a partitioned table.
+func isPartitioned(ctx context.Context, tx pgx.Tx) (bool, error) {
+	var partitioned bool
+	err := tx.QueryRow(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'outbox_messages'::regclass)`,
+	).Scan(&partitioned)
+	if err != nil {
+		return false, fmt.Errorf("failed to query pg_partitioned_table: %w", err)
+	}
+	return partitioned, nil
+}
+
+// createPartitions creates the missing partitions from the one that covers from up to the configured number of
+// periods after the one that covers now. It returns the names of the created partitions.
+func createPartitions(ctx context.Context, tx pgx.Tx, cfg Config, from, now time.Time) ([]string, error) {
+	period := cfg.period()
+	last := now.UTC().Truncate(period).Add(time.Duration(cfg.premake()) * period)
+
+	var created []string
+	for start := from.UTC().Truncate(period); !start.After(last); start = start.Add(period) {
+		name := partitionName(start)
+
+		var exists bool
+		if err := tx.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to query partition %s: %w", name, err)
+		}
+		if exists {
+			continue
+		}
+
+		if err := createPartition(ctx, tx, name, start, start.Add(period)); err != nil {
+			return nil, err
+		}
+		created = append(created, name)
+	}
+
+	return created, nil
+}
+
+// createPartition creates the partition for the range from start to end.
+// Messages of the range that went to the default partition, e.g. because partitions weren't maintained for longer
+// than the premade periods, would make creating the partition fail, so they are moved into it while the default
+// partition is detached. They are copied before they are deleted, and the detached partition isn't part of
+// outbox_messages, so the ID check doesn't see them twice.
+func createPartition(ctx context.Context, tx pgx.Tx, name string, start, end time.Time) error {
+	defaultPartition := pgx.Identifier{DefaultPartition}.Sanitize()
+
+	var inDefault bool
+	err := tx.QueryRow(
+		ctx,
+		fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE created_at >= $1 AND created_at < $2)`, defaultPartition),
+		start,
+		end,
+	).Scan(&inDefault)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %w", DefaultPartition, err)
+	}
+
+	createSQL := fmt.Sprintf(
+		`CREATE TABLE %s PARTITION OF outbox_messages FOR VALUES FROM ('%s') TO ('%s')`,
+		pgx.Identifier{name}.Sanitize(),
+		start.Format(time.RFC3339),
+		end.Format(time.RFC3339),
+	)
+	if !inDefault {
+		if _, err = tx.Exec(ctx, createSQL); err != nil {
+			return fmt.Errorf("failed to create partition %s: %w", name, err)
+		}
+		return nil
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE outbox_messages DETACH PARTITION %s`, defaultPartition))
+	if err != nil {
+		return fmt.Errorf("failed to detach %s: %w", DefaultPartition, err)
+	}
+	if _, err = tx.Exec(ctx, createSQL); err != nil {
+		return fmt.Errorf("failed to create partition %s: %w", name, err)
+	}
+	for _, sql := range []string{
+		fmt.Sprintf(
+			`INSERT INTO %s SELECT * FROM %s WHERE created_at >= $1 AND created_at < $2`,
+			pgx.Identifier{name}.Sanitize(),
+			defaultPartition,
+		),
+		fmt.Sprintf(`DELETE FROM %s WHERE created_at >= $1 AND created_at < $2`, defaultPartition),
+	} {
+		if _, err = tx.Exec(ctx, sql, start, end); err != nil {
+			return fmt.Errorf("failed to move messages from %s to partition %s: %w", DefaultPartition, name, err)
+		}
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf(`ALTER TABLE outbox_messages ATTACH PARTITION %s DEFAULT`, defaultPartition))
+	if err != nil {
+		return fmt.Errorf("failed to attach %s: %w", DefaultPartition, err)
+	}
+	return nil
+}
+
+// partitionName returns the name of the partition that starts at start.
+func partitionName(start time.Time) string {
+	return "outbox_messages_p" + start.UTC().Format("20060102_1504")
+}
@@ -0,0 +1,269 @@
+package partition
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+)
+
+func TestSetup(t *testing.T) {
+	t.Run("Partitions outbox_messages and keeps existing messages", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, outbox.StatusDelivered, "2 days")
+		insertMessage(t, pool, outbox.StatusUndelivered, "0 days")
+
+		setup(t, pool, Config{})
+		setup(t, pool, Config{}) // does nothing when already partitioned
+
+		var partitioned bool
+		err := pool.QueryRow(
+			ctx,
+			`SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'outbox_messages'::regclass)`,
+		).Scan(&partitioned)
+		if err != nil {
+			t.Fatalf("failed to query pg_partitioned_table: %v", err)
+		}
+		if !partitioned {
+			t.Fatalf("got outbox_messages not partitioned, want partitioned")
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages`), 2; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages_default`), 0; got != want {
+			t.Errorf("got %d messages in the default partition, want %d", got, want)
+		}
+		partitions := listPartitions(t, pool)
+		today := partitionName(time.Now().UTC().Truncate(24 * time.Hour))
+		for _, name := range []string{DefaultPartition, today} {
+			if !slices.Contains(partitions, name) {
+				t.Errorf("got %v partitions, want them to contain %s", partitions, name)
+			}
+		}
+
+		// Queries of the server and the worker keep working.
+
+		insertMessage(t, pool, outbox.StatusUndelivered, "0 days")
+		_, err = pool.Exec(
+			ctx,
+			`
+				UPDATE outbox_messages
+				SET status = $1
+				WHERE id IN (SELECT id FROM outbox_messages WHERE status = $2 FOR UPDATE SKIP LOCKED)
+			`,
+			outbox.StatusDelivered,
+			outbox.StatusUndelivered,
+		)
+		if err != nil {
+			t.Fatalf("failed to update messages: %v", err)
+		}
+		query := `SELECT COUNT(*) FROM outbox_messages WHERE status = 'delivered'`
+		if got, want := countMessages(t, pool, query), 3; got != want {
+			t.Errorf("got %d delivered messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Rejects messages with an ID that is already used", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		setup(t, pool, Config{})
+		insertMessage(t, pool, outbox.StatusUndelivered, "0 days")
+
+		_, err := pool.Exec(
+			ctx,
+			`
+				INSERT INTO outbox_messages (id, created_at, status, topic, key, value, headers)
+				SELECT id, created_at - interval '2 days', status, topic, key, value, headers
+				FROM outbox_messages
+			`,
+		)
+
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "23505" { // unique_violation
+			t.Errorf("got %v error, want unique violation", err)
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages`), 1; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Keeps messages older than the backfilled partitions in the default partition", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, outbox.StatusDelivered, "30 days")
+		insertMessage(t, pool, outbox.StatusUndelivered, "1 day")
+
+		setup(t, pool, Config{Backfill: 2})
+
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages_default`), 1; got != want {
+			t.Errorf("got %d messages in the default partition, want %d", got, want)
+		}
+		// The default partition, 2 past partitions, the current one and 3 future ones.
+		if got, want := len(listPartitions(t, pool)), 7; got != want {
+			t.Errorf("got %d partitions, want %d", got, want)
+		}
+	})
+}
+
+func TestMaintain(t *testing.T) {
+	t.Run("Creates future partitions and drops old settled ones", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, outbox.StatusDelivered, "3 days")
+		insertMessage(t, pool, outbox.StatusUndelivered, "2 days")
+		setup(t, pool, Config{})
+
+		m := NewMaintainer(Config{Archive: true, DropAfter: time.Millisecond, Premake: 5}, slog.Default(), pool)
+		created, dropped, err := m.Maintain(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := len(created), 2; got != want {
+			t.Errorf("got %d created partitions, want %d", got, want)
+		}
+		now := time.Now().UTC().Truncate(24 * time.Hour)
+		wantDropped := []string{
+			partitionName(now.Add(-3 * 24 * time.Hour)), // delivered messages only
+			partitionName(now.Add(-1 * 24 * time.Hour)), // no messages
+		}
+		if got, want := dropped, wantDropped; !slices.Equal(got, want) {
+			t.Errorf("got %v dropped partitions, want %v", got, want)
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages`), 1; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+		if !slices.Contains(listPartitions(t, pool), partitionName(now.Add(5*24*time.Hour))) {
+			t.Errorf("got no partition 5 days ahead, want one")
+		}
+		query := `SELECT removed_count FROM outbox_retention_counts WHERE status = 'delivered'`
+		if got, want := countMessages(t, pool, query), 1; got != want {
+			t.Errorf("got %d removed delivered messages, want %d", got, want)
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages_archive`), 1; got != want {
+			t.Errorf("got %d archived messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Doesn't drop partitions without a drop delay", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, outbox.StatusDelivered, "3 days")
+		setup(t, pool, Config{})
+
+		m := NewMaintainer(Config{}, slog.Default(), pool)
+		_, dropped, err := m.Maintain(context.Background())
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if len(dropped) > 0 {
+			t.Errorf("got %v dropped partitions, want none", dropped)
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages`), 1; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Creates partitions for messages in the default partition", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		setup(t, pool, Config{})
+		insertMessage(t, pool, outbox.StatusUndelivered, "-10 days") // after the premade partitions
+
+		m := NewMaintainer(Config{Premake: 12}, slog.Default(), pool)
+		created, _, err := m.Maintain(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		name := partitionName(time.Now().UTC().Truncate(24 * time.Hour).Add(10 * 24 * time.Hour))
+		if !slices.Contains(created, name) {
+			t.Errorf("got %v created partitions, want them to contain %s", created, name)
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM `+name), 1; got != want {
+			t.Errorf("got %d messages in %s, want %d", got, name, want)
+		}
+		if got, want := countMessages(t, pool, `SELECT COUNT(*) FROM outbox_messages_default`), 0; got != want {
+			t.Errorf("got %d messages in the default partition, want %d", got, want)
+		}
+		if !slices.Contains(listPartitions(t, pool), DefaultPartition) {
+			t.Errorf("got default partition detached, want attached")
+		}
+	})
+}
+
+func setup(t *testing.T, pool *pgxpool.Pool, cfg Config) {
+	t.Helper()
+
+	conn, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	if err = Setup(context.Background(), conn.Conn(), cfg); err != nil {
+		t.Fatalf("failed to set up partitions: %v", err)
+	}
+}
+
+func insertMessage(t *testing.T, pool *pgxpool.Pool, status, age string) {
+	t.Helper()
+
+	_, err := pool.Exec(
+		context.Background(),
+		`
+			INSERT INTO outbox_messages (created_at, status, topic, key, value, headers)
+			VALUES (now() - $1::interval, $2, 'example', 'key', 'value', '[]')
+		`,
+		age,
+		status,
+	)
+	if err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+}
+
+func countMessages(t *testing.T, pool *pgxpool.Pool, query string) int {
+	t.Helper()
+
+	var count int
+	if err := pool.QueryRow(context.Background(), query).Scan(&count); err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	return count
+}
+
+func listPartitions(t *testing.T, pool *pgxpool.Pool) []string {
+	t.Helper()
+
+	rows, err := pool.Query(
+		context.Background(),
+		`
+			SELECT c.relname
+			FROM pg_inherits i
+			JOIN pg_class c ON c.oid = i.inhrelid
+			WHERE i.inhparent = 'outbox_messages'::regclass
+		`,
+	)
+	if err != nil {
+		t.Fatalf("failed to query partitions: %v", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			t.Fatalf("failed to scan partition: %v", err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,126 @@
+// Package postgrestest provides utilities for tests that need a Postgres database.
+package postgrestest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DSNEnv is the environment variable that holds the DSN of a Postgres database provisioned with postgres-up.
+// Tests that need Postgres are skipped when it is unset.
+const DSNEnv = "OUTBOX_TEST_POSTGRES_DSN"
+
+// NewPool returns a new pool connected to an isolated schema.
+// The schema is created from the tables of the public schema and dropped when the test finishes.
+func NewPool(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+
+	dsn := os.Getenv(DSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", DSNEnv)
+	}
+
+	ctx := context.Background()
+	schema := newSchemaName(t)
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatalf("failed to connect to Postgres: %v", err)
+	}
+	defer func() {
+		_ = conn.Close(ctx)
+	}()
+
+	if err = createSchema(ctx, conn, schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := dropSchema(context.Background(), dsn, schema); err != nil {
+			t.Errorf("failed to drop schema: %v", err)
+		}
+	})
+
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("failed to parse Postgres DSN: %v", err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("failed to create Postgres pool: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	return pool
+}
+
+func newSchemaName(t testing.TB) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("failed to generate schema name: %v", err)
+	}
+	return "test_" + hex.EncodeToString(b)
+}
+
+func createSchema(ctx context.Context, conn *pgx.Conn, schema string) error {
+	tables, err := publicTables(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	quotedSchema := pgx.Identifier{schema}.Sanitize()
+	if _, err = conn.Exec(ctx, fmt.Sprintf(`CREATE SCHEMA %s`, quotedSchema)); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		_, err = conn.Exec(ctx, fmt.Sprintf(
+			`CREATE TABLE %s (LIKE %s INCLUDING ALL)`,
+			pgx.Identifier{schema, table}.Sanitize(),
+			pgx.Identifier{"public", table}.Sanitize(),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to copy table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func publicTables(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	result, err := conn.Query(
+		ctx,
+		`
+			SELECT table_name
+			FROM information_schema.tables
+			WHERE table_schema = 'public' AND table_type = 'BASE TABLE' AND table_name <> 'schema_migrations'
+		`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tables: %w", err)
+	}
+	tables, err := pgx.CollectRows(result, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect tables: %w", err)
+	}
+	return tables, nil
+}
+
+func dropSchema(ctx context.Context, dsn, schema string) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close(ctx)
+	}()
+
+	_, err = conn.Exec(ctx, fmt.Sprintf(`DROP SCHEMA %s CASCADE`, pgx.Identifier{schema}.Sanitize()))
+	return err
+}
@@ -0,0 +1,86 @@
+// Package publishertest provides an in-memory publisher for tests.
+package publishertest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// Publisher is an outbox.Publisher that keeps published messages in memory.
+// The zero value is a publisher that publishes every message.
+type Publisher struct {
+	Delay time.Duration              // before every publish, unless ctx is canceled
+	Err   error                      // fails every message
+	Fail  func(outbox.Message) error // fails individual messages, if set
+
+	mu        sync.Mutex
+	published []outbox.Message
+	publishes int
+	closed    bool
+}
+
+// Publish records msgs as published unless they fail.
+// If ctx is canceled during the delay, every message fails with the error of ctx.
+func (p *Publisher) Publish(ctx context.Context, msgs []outbox.Message) []error {
+	errs := make([]error, len(msgs))
+
+	timer := time.NewTimer(p.Delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		for i := range errs {
+			errs[i] = ctx.Err()
+		}
+		return errs
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.publishes++
+
+	for i, m := range msgs {
+		switch {
+		case p.Err != nil:
+			errs[i] = p.Err
+		case p.Fail != nil:
+			errs[i] = p.Fail(m)
+		}
+		if errs[i] == nil {
+			p.published = append(p.published, m)
+		}
+	}
+	return errs
+}
+
+// Close marks the publisher as closed.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+// Messages returns the published messages in the order they were published.
+func (p *Publisher) Messages() []outbox.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]outbox.Message(nil), p.published...)
+}
+
+// PublishCount returns the number of calls to Publish that weren't canceled.
+func (p *Publisher) PublishCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.publishes
+}
+
+// Closed reports whether Close was called.
+func (p *Publisher) Closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
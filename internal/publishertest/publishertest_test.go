@@ -0,0 +1,54 @@
+package publishertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+func TestPublisher(t *testing.T) {
+	t.Run("Records published messages and fails individual messages", func(t *testing.T) {
+		p := &Publisher{Fail: func(m outbox.Message) error {
+			if m.Topic == "missing" {
+				return errors.New("unknown topic")
+			}
+			return nil
+		}}
+
+		errs := p.Publish(context.Background(), []outbox.Message{{Topic: "a"}, {Topic: "missing"}, {Topic: "b"}})
+
+		for i, wantFailed := range []bool{false, true, false} {
+			if got := errs[i] != nil; got != wantFailed {
+				t.Errorf("got failed %v for message %d, want %v", got, i, wantFailed)
+			}
+		}
+		msgs := p.Messages()
+		if got, want := len(msgs), 2; got != want {
+			t.Fatalf("got %d messages, want %d", got, want)
+		}
+		if got, want := msgs[1].Topic, "b"; got != want {
+			t.Errorf("got %q topic, want %q", got, want)
+		}
+		if got, want := p.PublishCount(), 1; got != want {
+			t.Errorf("got %d publishes, want %d", got, want)
+		}
+	})
+
+	t.Run("Fails every message when ctx is canceled during the delay", func(t *testing.T) {
+		p := &Publisher{Delay: time.Hour}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		errs := p.Publish(ctx, []outbox.Message{{Topic: "a"}})
+
+		if got, want := errs[0], context.Canceled; !errors.Is(got, want) {
+			t.Errorf("got %v error, want %v", got, want)
+		}
+		if got, want := len(p.Messages()), 0; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+}
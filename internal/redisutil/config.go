@@ -0,0 +1,31 @@
+package redisutil
+
+import "time"
+
+// Config holds Redis configuration.
+// The zero value is a valid configuration.
+type Config struct {
+	Enabled      bool          `env:"ENABLED"`                 // send messages to Redis Streams
+	MaxLen       int64         `env:"MAX_LEN"`                 // trims streams to about this many entries, 0 means unlimited
+	MaxLenExact  bool          `env:"MAX_LEN_EXACT"`           // trims streams exactly, which is slower
+	StreamPrefix string        `env:"STREAM_PREFIX"`           // prepended to topics to make stream names
+	Timeout      time.Duration `env:"TIMEOUT"`                 // default: 10s
+	Topics       []string      `env:"TOPICS" envSeparator:","` // default: every topic
+	URL          string        `env:"URL"`                     // default: "redis://127.0.0.1:6379/0"
+}
+
+func (c Config) timeout() time.Duration {
+	t := c.Timeout
+	if t == 0 {
+		t = 10 * time.Second
+	}
+	return t
+}
+
+func (c Config) url() string {
+	u := c.URL
+	if u == "" {
+		u = "redis://127.0.0.1:6379/0"
+	}
+	return u
+}
@@ -0,0 +1,103 @@
+// Package redisutil publishes outbox messages to Redis Streams.
+package redisutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/redis/go-redis/v9"
+)
+
+// Publisher adds messages to Redis streams.
+// It should be created with NewPublisher.
+type Publisher struct {
+	cfg         Config
+	redisClient *redis.Client
+}
+
+// NewPublisher creates a new Publisher.
+// It is the caller's responsibility to close the publisher when done.
+func NewPublisher(cfg Config) (*Publisher, error) {
+	opts, err := redis.ParseURL(cfg.url())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+	return &Publisher{cfg: cfg, redisClient: redis.NewClient(opts)}, nil
+}
+
+// Publish adds messages with XADD to the streams named after their topics with the stream prefix.
+// The commands of a batch are sent in one pipeline. If the max length is set, every XADD trims its stream to about
+// that many entries. It returns the error of each message, which is nil for messages that were added.
+func (p *Publisher) Publish(ctx context.Context, msgs []outbox.Message) []error {
+	errs := make([]error, len(msgs))
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.timeout())
+	defer cancel()
+
+	pipe := p.redisClient.Pipeline()
+	cmds := make([]*redis.StringCmd, len(msgs))
+	for i, m := range msgs {
+		args, err := p.newXAddArgs(m)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		cmds[i] = pipe.XAdd(ctx, args)
+	}
+	if pipe.Len() == 0 {
+		return errs
+	}
+
+	// Every command has its own error, except when the pipeline failed before the commands were sent, such as when the
+	// client couldn't connect. Then the commands have neither an error nor the ID of an added entry.
+	_, execErr := pipe.Exec(ctx)
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		errs[i] = cmd.Err()
+		if errs[i] == nil && cmd.Val() == "" {
+			errs[i] = fmt.Errorf("failed to add message: %w", execErr)
+		}
+	}
+	return errs
+}
+
+// Close closes the client.
+func (p *Publisher) Close() error {
+	return p.redisClient.Close()
+}
+
+// newXAddArgs maps a message to the arguments of XADD.
+// The entry has the fields id, key, value and headers, where headers is a JSON array of objects with a key and a
+// value, so consumers get the headers in order and with duplicate keys.
+func (p *Publisher) newXAddArgs(m outbox.Message) (*redis.XAddArgs, error) {
+	headers := make([]streamHeader, len(m.Headers))
+	for i, h := range m.Headers {
+		headers[i] = streamHeader{Key: h.Key, Value: string(h.Value)}
+	}
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal headers: %w", err)
+	}
+
+	return &redis.XAddArgs{
+		Stream: p.cfg.StreamPrefix + m.Topic,
+		MaxLen: p.cfg.MaxLen,
+		Approx: p.cfg.MaxLen > 0 && !p.cfg.MaxLenExact,
+		Values: []any{
+			"id", m.ID,
+			"key", m.Key,
+			"value", m.Value,
+			"headers", headersJSON,
+		},
+	}, nil
+}
+
+// streamHeader is a header of a message in the headers field of a stream entry.
+type streamHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
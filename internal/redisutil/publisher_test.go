@@ -0,0 +1,113 @@
+package redisutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestPublish(t *testing.T) {
+	t.Run("Adds messages to the streams of their topics", func(t *testing.T) {
+		ctx := context.Background()
+		p, redisClient := newTestPublisher(t, Config{StreamPrefix: "outbox:"})
+
+		errs := p.Publish(ctx, []outbox.Message{{
+			ID:      "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+			Topic:   "orders",
+			Key:     []byte("a-key"),
+			Value:   []byte("a-value"),
+			Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+		}})
+		if errs[0] != nil {
+			t.Fatalf("got %v error, want nil", errs[0])
+		}
+
+		entries, err := redisClient.XRange(ctx, "outbox:orders", "-", "+").Result()
+		if err != nil {
+			t.Fatalf("failed to read stream: %v", err)
+		}
+		if got, want := len(entries), 1; got != want {
+			t.Fatalf("got %d entries, want %d", got, want)
+		}
+		wantValues := map[string]string{
+			"id":      "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+			"key":     "a-key",
+			"value":   "a-value",
+			"headers": `[{"key":"Content-Type","value":"application/json"}]`,
+		}
+		for field, want := range wantValues {
+			if got := entries[0].Values[field]; got != want {
+				t.Errorf("got %q %s field, want %q", got, field, want)
+			}
+		}
+	})
+
+	t.Run("Trims streams to the max length", func(t *testing.T) {
+		ctx := context.Background()
+		p, redisClient := newTestPublisher(t, Config{MaxLen: 2, MaxLenExact: true})
+
+		msgs := []outbox.Message{{Topic: "orders"}, {Topic: "orders"}, {Topic: "orders"}}
+		for _, err := range p.Publish(ctx, msgs) {
+			if err != nil {
+				t.Fatalf("got %v error, want nil", err)
+			}
+		}
+
+		if got, want := redisClient.XLen(ctx, "orders").Val(), int64(2); got != want {
+			t.Errorf("got %d entries, want %d", got, want)
+		}
+	})
+
+	t.Run("Reports the result of each entry", func(t *testing.T) {
+		ctx := context.Background()
+		p, redisClient := newTestPublisher(t, Config{})
+		if err := redisClient.Set(ctx, "taken", "not a stream", 0).Err(); err != nil {
+			t.Fatalf("failed to set key: %v", err)
+		}
+
+		errs := p.Publish(ctx, []outbox.Message{{Topic: "orders"}, {Topic: "taken"}, {Topic: "payments"}})
+
+		for i, wantFailed := range []bool{false, true, false} {
+			if got := errs[i] != nil; got != wantFailed {
+				t.Errorf("got failed %v for message %d, want %v (error: %v)", got, i, wantFailed, errs[i])
+			}
+		}
+	})
+
+	t.Run("Fails every message when Redis is unavailable", func(t *testing.T) {
+		ctx := context.Background()
+		srv := miniredis.RunT(t)
+		p, err := NewPublisher(Config{URL: "redis://" + srv.Addr()})
+		if err != nil {
+			t.Fatalf("failed to create publisher: %v", err)
+		}
+		t.Cleanup(func() { _ = p.Close() })
+		srv.Close()
+
+		for i, err := range p.Publish(ctx, []outbox.Message{{Topic: "orders"}, {Topic: "payments"}}) {
+			if err == nil {
+				t.Errorf("got nil error for message %d, want non-nil", i)
+			}
+		}
+	})
+}
+
+// newTestPublisher starts an in-memory Redis server and returns a publisher and a client connected to it.
+func newTestPublisher(t *testing.T, cfg Config) (*Publisher, *redis.Client) {
+	t.Helper()
+
+	srv := miniredis.RunT(t)
+	cfg.URL = "redis://" + srv.Addr()
+	p, err := NewPublisher(cfg)
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+
+	redisClient := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	t.Cleanup(func() { _ = redisClient.Close() })
+	return p, redisClient
+}
@@ -0,0 +1,73 @@
+package retention
+
+import "time"
+
+// Config holds the retention configuration.
+// The zero value is a valid configuration.
+type Config struct {
+	Archive           bool          `env:"ARCHIVE"`             // archive removed rows to outbox_messages_archive
+	BatchSize         int           `env:"BATCH_SIZE"`          // default: 1000
+	DeadAge           time.Duration `env:"DEAD_AGE"`            // default: 720h
+	DeliveredAge      time.Duration `env:"DELIVERED_AGE"`       // default: 168h
+	Enabled           bool          `env:"ENABLED"`             // run inside the worker
+	ExpiredAge        time.Duration `env:"EXPIRED_AGE"`         // default: 168h
+	IdempotencyKeyAge time.Duration `env:"IDEMPOTENCY_KEY_AGE"` // default: 24h, at least the server's idempotency window
+	Interval          time.Duration `env:"INTERVAL"`            // default: 1m
+	Timeout           time.Duration `env:"TIMEOUT"`             // default: 10s
+}
+
+func (c Config) batchSize() int {
+	s := c.BatchSize
+	if s == 0 {
+		s = 1000
+	}
+	return s
+}
+
+func (c Config) deadAge() time.Duration {
+	a := c.DeadAge
+	if a == 0 {
+		a = 30 * 24 * time.Hour
+	}
+	return a
+}
+
+func (c Config) deliveredAge() time.Duration {
+	a := c.DeliveredAge
+	if a == 0 {
+		a = 7 * 24 * time.Hour
+	}
+	return a
+}
+
+func (c Config) expiredAge() time.Duration {
+	a := c.ExpiredAge
+	if a == 0 {
+		a = 7 * 24 * time.Hour
+	}
+	return a
+}
+
+func (c Config) idempotencyKeyAge() time.Duration {
+	a := c.IdempotencyKeyAge
+	if a == 0 {
+		a = 24 * time.Hour
+	}
+	return a
+}
+
+func (c Config) interval() time.Duration {
+	i := c.Interval
+	if i == 0 {
+		i = time.Minute
+	}
+	return i
+}
+
+func (c Config) timeout() time.Duration {
+	t := c.Timeout
+	if t == 0 {
+		t = 10 * time.Second
+	}
+	return t
+}
@@ -0,0 +1,186 @@
+// Package retention removes old delivered, dead and expired messages from the outbox and old idempotency keys.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// Cleaner removes delivered, dead and expired messages older than their retention age from outbox_messages.
+// It should be created with NewCleaner.
+type Cleaner struct {
+	cfg          Config
+	log          *slog.Logger
+	postgresPool *pgxpool.Pool
+}
+
+// NewCleaner creates a new Cleaner.
+func NewCleaner(cfg Config, log *slog.Logger, postgresPool *pgxpool.Pool) *Cleaner {
+	return &Cleaner{
+		cfg:          cfg,
+		log:          log.With("component", "retention"),
+		postgresPool: postgresPool,
+	}
+}
+
+// Run removes old messages every interval until ctx is canceled.
+func (c *Cleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.interval())
+	defer ticker.Stop()
+
+	for {
+		removed, err := c.Clean(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.log.Error("failed to remove old messages", "error", err)
+		}
+		for status, count := range removed {
+			if count > 0 {
+				c.log.Info("removed old messages", "status", status, "count", count, "archived", c.cfg.Archive)
+			}
+		}
+
+		removedKeys, err := c.CleanIdempotencyKeys(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.log.Error("failed to remove old idempotency keys", "error", err)
+		}
+		if removedKeys > 0 {
+			c.log.Info("removed old idempotency keys", "count", removedKeys)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Clean removes delivered, dead and expired messages older than their retention age.
+// Messages are removed in batches, each in its own short transaction, so that rows aren't locked for long.
+// It returns the number of removed messages by status, including when it fails midway.
+func (c *Cleaner) Clean(ctx context.Context) (map[string]int, error) {
+	removed := make(map[string]int)
+	ages := []struct {
+		status string
+		age    time.Duration
+	}{
+		{status: outbox.StatusDelivered, age: c.cfg.deliveredAge()},
+		{status: outbox.StatusDead, age: c.cfg.deadAge()},
+		{status: outbox.StatusExpired, age: c.cfg.expiredAge()},
+	}
+
+	for _, a := range ages {
+		for {
+			count, err := c.removeBatch(ctx, a.status, a.age)
+			removed[a.status] += count
+			if err != nil {
+				return removed, err
+			}
+			if count < c.cfg.batchSize() {
+				break
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// CleanIdempotencyKeys removes idempotency keys older than their retention age in batches.
+// It returns the number of removed keys, including when it fails midway.
+func (c *Cleaner) CleanIdempotencyKeys(ctx context.Context) (int, error) {
+	removed := 0
+	for {
+		count, err := c.removeIdempotencyKeyBatch(ctx)
+		removed += count
+		if err != nil {
+			return removed, err
+		}
+		if count < c.cfg.batchSize() {
+			return removed, nil
+		}
+	}
+}
+
+// removeIdempotencyKeyBatch removes a batch of idempotency keys older than their retention age and returns their
+// number.
+func (c *Cleaner) removeIdempotencyKeyBatch(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.timeout())
+	defer cancel()
+
+	tag, err := c.postgresPool.Exec(
+		ctx,
+		`
+			DELETE FROM idempotency_keys
+			WHERE (client, key) IN (
+				SELECT client, key
+				FROM idempotency_keys
+				WHERE created_at < now() - @ageMilliseconds * interval '1 millisecond'
+				LIMIT @batchSize
+				FOR UPDATE SKIP LOCKED
+			)
+		`,
+		pgx.NamedArgs{
+			"ageMilliseconds": c.cfg.idempotencyKeyAge().Milliseconds(),
+			"batchSize":       c.cfg.batchSize(),
+		},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove idempotency_keys: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// removeBatch removes a batch of messages with the status that are older than age and returns their number.
+// Removed messages are archived if archiving is enabled and counted in outbox_retention_counts.
+func (c *Cleaner) removeBatch(ctx context.Context, status string, age time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.timeout())
+	defer cancel()
+
+	var count int
+	err := c.postgresPool.QueryRow(
+		ctx,
+		`
+			WITH removed AS (
+				DELETE FROM outbox_messages
+				WHERE id IN (
+					SELECT id
+					FROM outbox_messages
+					WHERE status = @status AND created_at < now() - @ageMilliseconds * interval '1 millisecond'
+					LIMIT @batchSize
+					FOR UPDATE SKIP LOCKED
+				)
+				RETURNING *
+			),
+			archived AS (
+				INSERT INTO outbox_messages_archive (id, status, created_at, message)
+				SELECT id, status, created_at, to_jsonb(removed)
+				FROM removed
+				WHERE @archive
+			),
+			counted AS (
+				INSERT INTO outbox_retention_counts (status, removed_count)
+				SELECT @status, COUNT(*)
+				FROM removed
+				ON CONFLICT (status) DO UPDATE
+				SET removed_count = outbox_retention_counts.removed_count + excluded.removed_count
+			)
+			SELECT COUNT(*) FROM removed
+		`,
+		pgx.NamedArgs{
+			"status":          status,
+			"ageMilliseconds": age.Milliseconds(),
+			"batchSize":       c.cfg.batchSize(),
+			"archive":         c.cfg.Archive,
+		},
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove %s outbox_messages: %w", status, err)
+	}
+	return count, nil
+}
@@ -0,0 +1,145 @@
+package retention
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+)
+
+func TestClean(t *testing.T) {
+	t.Run("Removes old delivered, dead and expired messages in batches", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		for i := 0; i < 5; i++ {
+			insertMessage(t, pool, outbox.StatusDelivered, "10 days")
+		}
+		insertMessage(t, pool, outbox.StatusDelivered, "1 day")
+		insertMessage(t, pool, outbox.StatusDead, "10 days")
+		insertMessage(t, pool, outbox.StatusDead, "40 days")
+		insertMessage(t, pool, outbox.StatusExpired, "1 day")
+		insertMessage(t, pool, outbox.StatusExpired, "10 days")
+		insertMessage(t, pool, outbox.StatusUndelivered, "40 days")
+
+		c := NewCleaner(Config{BatchSize: 2}, slog.Default(), pool)
+		removed, err := c.Clean(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := removed[outbox.StatusDelivered], 5; got != want {
+			t.Errorf("got %d removed delivered messages, want %d", got, want)
+		}
+		if got, want := removed[outbox.StatusDead], 1; got != want {
+			t.Errorf("got %d removed dead messages, want %d", got, want)
+		}
+		if got, want := removed[outbox.StatusExpired], 1; got != want {
+			t.Errorf("got %d removed expired messages, want %d", got, want)
+		}
+		for status, want := range map[string]int{
+			outbox.StatusDelivered:   1,
+			outbox.StatusDead:        1,
+			outbox.StatusExpired:     1,
+			outbox.StatusUndelivered: 1,
+		} {
+			query := `SELECT COUNT(*) FROM outbox_messages WHERE status = $1`
+			if got := queryCount(t, pool, query, status); got != want {
+				t.Errorf("got %d %s messages, want %d", got, status, want)
+			}
+		}
+		query := `SELECT removed_count FROM outbox_retention_counts WHERE status = $1`
+		if got, want := queryCount(t, pool, query, outbox.StatusDelivered), 5; got != want {
+			t.Errorf("got %d counted removed delivered messages, want %d", got, want)
+		}
+		if got, want := queryCount(t, pool, `SELECT COUNT(*) FROM outbox_messages_archive`), 0; got != want {
+			t.Errorf("got %d archived messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Archives removed messages", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, outbox.StatusDelivered, "10 days")
+
+		c := NewCleaner(Config{Archive: true}, slog.Default(), pool)
+		if _, err := c.Clean(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		var value string
+		err := pool.QueryRow(
+			ctx,
+			`SELECT message->>'value' FROM outbox_messages_archive WHERE status = $1`,
+			outbox.StatusDelivered,
+		).Scan(&value)
+		if err != nil {
+			t.Fatalf("failed to query archived message: %v", err)
+		}
+		if got, want := value, "value"; got != want {
+			t.Errorf("got %q archived value, want %q", got, want)
+		}
+		if got, want := queryCount(t, pool, `SELECT COUNT(*) FROM outbox_messages`), 0; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+}
+
+func TestCleanIdempotencyKeys(t *testing.T) {
+	t.Run("Removes old idempotency keys", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		for _, age := range []string{"1 hour", "2 days", "3 days"} {
+			_, err := pool.Exec(
+				ctx,
+				`INSERT INTO idempotency_keys (client, key, created_at, request_hash) VALUES ('', $1, now() - $1::interval, '')`,
+				age,
+			)
+			if err != nil {
+				t.Fatalf("failed to insert idempotency key: %v", err)
+			}
+		}
+
+		c := NewCleaner(Config{BatchSize: 1}, slog.Default(), pool)
+		removed, err := c.CleanIdempotencyKeys(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := removed, 2; got != want {
+			t.Errorf("got %d removed idempotency keys, want %d", got, want)
+		}
+		if got, want := queryCount(t, pool, `SELECT COUNT(*) FROM idempotency_keys`), 1; got != want {
+			t.Errorf("got %d idempotency keys, want %d", got, want)
+		}
+	})
+}
+
+func insertMessage(t *testing.T, pool *pgxpool.Pool, status, age string) {
+	t.Helper()
+
+	_, err := pool.Exec(
+		context.Background(),
+		`
+			INSERT INTO outbox_messages (created_at, status, topic, key, value, headers)
+			VALUES (now() - $1::interval, $2, 'example', 'key', 'value', '[]')
+		`,
+		age,
+		status,
+	)
+	if err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+}
+
+func queryCount(t *testing.T, pool *pgxpool.Pool, query string, args ...any) int {
+	t.Helper()
+
+	var count int
+	if err := pool.QueryRow(context.Background(), query, args...).Scan(&count); err != nil {
+		t.Fatalf("failed to query count: %v", err)
+	}
+	return count
+}
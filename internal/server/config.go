@@ -7,8 +7,9 @@ import (
 // Config holds the server configuration.
 // The zero value is a valid configuration.
 type Config struct {
-	Host              string        `env:"HOST"` // default: "127.0.0.1"
-	Port              int           `env:"PORT"` // default: 8080
+	Host              string        `env:"HOST"`               // default: "127.0.0.1"
+	IdempotencyWindow time.Duration `env:"IDEMPOTENCY_WINDOW"` // default: 24h, how long requests are replayed
+	Port              int           `env:"PORT"`               // default: 8080
 	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT"`
 	TLS               TLSConfig     `envPrefix:"TLS_"`
 }
@@ -29,6 +30,14 @@ func (c Config) host() string {
 	return h
 }
 
+func (c Config) idempotencyWindow() time.Duration {
+	w := c.IdempotencyWindow
+	if w == 0 {
+		w = 24 * time.Hour
+	}
+	return w
+}
+
 func (c Config) port() int {
 	p := c.Port
 	if p == 0 {
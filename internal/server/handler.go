@@ -1,24 +1,43 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/k11v/outbox/internal/outbox"
-	"github.com/segmentio/kafka-go"
 )
 
 type handler struct {
-	kafkaWriter  *kafka.Writer // required, its Topic must be unset
-	log          *slog.Logger  // required
-	postgresPool *pgxpool.Pool // required
+	idempotencyWindow time.Duration // required
+	log               *slog.Logger  // required
+	postgresPool      *pgxpool.Pool // required
 }
 
+const (
+	// idempotencyKeyHeader is the request header with a key that makes retries of the request create one message.
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyReplayedHeader is the response header that is set when the response is replayed for a retry.
+	idempotencyReplayedHeader = "Idempotency-Replayed"
+	// clientIDHeader is the request header that identifies the client. Idempotency keys are scoped per client, so it
+	// is required with idempotencyKeyHeader.
+	clientIDHeader = "X-Client-ID"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// errIdempotencyKeyReused is returned when an idempotency key is reused with a different request.
+var errIdempotencyKeyReused = errors.New("idempotency key is already used with a different request")
+
 type getHealthResponse struct {
 	Status string `json:"status"`
 }
@@ -34,10 +53,13 @@ func (h *handler) handleGetHealth(w http.ResponseWriter, _ *http.Request) {
 }
 
 type createMessageRequest struct {
-	Topic   string                       `json:"topic"`
-	Key     string                       `json:"key"`
-	Value   string                       `json:"value"`
-	Headers []createMessageHeaderRequest `json:"headers"`
+	Topic        string                       `json:"topic"`
+	Key          string                       `json:"key"`
+	Value        string                       `json:"value"`
+	Headers      []createMessageHeaderRequest `json:"headers"`
+	DeliverAfter *time.Time                   `json:"deliver_after"` // optional
+	ExpiresAt    *time.Time                   `json:"expires_at"`    // optional
+	Priority     int32                        `json:"priority"`      // optional, higher is sent first
 }
 
 type createMessageHeaderRequest struct {
@@ -45,6 +67,24 @@ type createMessageHeaderRequest struct {
 	Value string `json:"value"`
 }
 
+type createMessageResponse struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// idempotencyKey is an idempotency key of a request.
+type idempotencyKey struct {
+	client      string
+	key         string
+	requestHash []byte
+}
+
+// storedResponse is a response that is stored with its idempotency key to be replayed for retries.
+type storedResponse struct {
+	status   int
+	body     []byte
+	replayed bool
+}
+
 func (r *createMessageRequest) validate() error {
 	if r.Topic == "" {
 		return fmt.Errorf("topic is required")
@@ -60,6 +100,9 @@ func (r *createMessageRequest) validate() error {
 			return fmt.Errorf("header key is required at index %d", i)
 		}
 	}
+	if r.DeliverAfter != nil && r.ExpiresAt != nil && !r.ExpiresAt.After(*r.DeliverAfter) {
+		return fmt.Errorf("expires_at must be after deliver_after")
+	}
 	return nil
 }
 
@@ -76,25 +119,91 @@ func (h *handler) handleCreateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.createMessage(r.Context(), req); err != nil {
+	var idemKey *idempotencyKey
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			msg := fmt.Sprintf("invalid request: idempotency key is longer than %d bytes", maxIdempotencyKeyLength)
+			_, _ = w.Write([]byte(msg))
+			return
+		}
+		// Without a client, unrelated clients that happen to use the same key would get each other's responses.
+		if r.Header.Get(clientIDHeader) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			msg := fmt.Sprintf("invalid request: %s header is required with %s header", clientIDHeader, idempotencyKeyHeader)
+			_, _ = w.Write([]byte(msg))
+			return
+		}
+		requestHash, err := hashRequest(req)
+		if err != nil {
+			h.log.Error("failed to hash request", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("internal server error"))
+			return
+		}
+		idemKey = &idempotencyKey{client: r.Header.Get(clientIDHeader), key: key, requestHash: requestHash}
+	}
+
+	resp, err := h.createMessage(r.Context(), req, idemKey)
+	if errors.Is(err, errIdempotencyKeyReused) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
 		h.log.Error("failed to create message", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte("internal server error"))
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	if resp.replayed {
+		w.Header().Set(idempotencyReplayedHeader, "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	_, _ = w.Write(resp.body)
+}
+
+// hashRequest returns the SHA-256 of the request encoded as JSON, which doesn't depend on how the request was
+// formatted by the client.
+func hashRequest(req createMessageRequest) ([]byte, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
 }
 
-func (h *handler) createMessage(ctx context.Context, req createMessageRequest) error {
+// createMessage creates a message and returns the response to the request.
+// If idemKey is not nil and was used within the idempotency window, it returns the stored response of the request
+// that used it instead.
+func (h *handler) createMessage(
+	ctx context.Context,
+	req createMessageRequest,
+	idemKey *idempotencyKey,
+) (storedResponse, error) {
 	tx, err := h.postgresPool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to start transaction: %w", err)
+		return storedResponse{}, fmt.Errorf("failed to start transaction: %w", err)
 	}
 	defer func(tx pgx.Tx) {
 		_ = tx.Rollback(ctx)
 	}(tx)
 
+	// Claim the idempotency key. A request that uses the same key concurrently waits here until this transaction ends.
+
+	if idemKey != nil {
+		stored, err := h.claimIdempotencyKey(ctx, tx, *idemKey)
+		if err != nil {
+			return storedResponse{}, err
+		}
+		if stored != nil {
+			return *stored, nil
+		}
+	}
+
 	// Insert into message_infos just to have a need for the transactional outbox pattern.
 
 	_, err = tx.Exec(
@@ -103,39 +212,137 @@ func (h *handler) createMessage(ctx context.Context, req createMessageRequest) e
 		len(req.Value),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to insert into message_infos: %w", err)
+		return storedResponse{}, fmt.Errorf("failed to insert into message_infos: %w", err)
 	}
 
 	// Insert outbox_messages to have a message to send to Kafka by the worker.
 
 	headersJSON, err := json.Marshal(req.Headers)
 	if err != nil {
-		return fmt.Errorf("failed to marshal headers: %w", err)
+		return storedResponse{}, fmt.Errorf("failed to marshal headers: %w", err)
 	}
 
-	_, err = tx.Exec(
+	// Scheduled messages become undelivered once their time comes, even if it has already come.
+
+	status := outbox.StatusUndelivered
+	if req.DeliverAfter != nil {
+		status = outbox.StatusScheduled
+	}
+
+	var id uuid.UUID
+	err = tx.QueryRow(
 		ctx,
-		`INSERT INTO outbox_messages (status, topic, key, value, headers) VALUES ($1, $2, $3, $4, $5)`,
-		outbox.StatusUndelivered,
+		`
+			INSERT INTO outbox_messages (status, topic, key, value, headers, deliver_after, expires_at, priority)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING id
+		`,
+		status,
 		req.Topic,
 		req.Key,
 		req.Value,
 		headersJSON,
-	)
+		req.DeliverAfter,
+		req.ExpiresAt,
+		req.Priority,
+	).Scan(&id)
+	if err != nil {
+		return storedResponse{}, fmt.Errorf("failed to insert into outbox_messages: %w", err)
+	}
+
+	respBody, err := json.Marshal(createMessageResponse{ID: id})
 	if err != nil {
-		return fmt.Errorf("failed to insert into outbox_messages: %w", err)
+		return storedResponse{}, fmt.Errorf("failed to marshal response: %w", err)
+	}
+	resp := storedResponse{status: http.StatusCreated, body: respBody}
+
+	// Store the response to replay it for retries.
+
+	if idemKey != nil {
+		_, err = tx.Exec(
+			ctx,
+			`UPDATE idempotency_keys SET response_status = $3, response_body = $4 WHERE client = $1 AND key = $2`,
+			idemKey.client,
+			idemKey.key,
+			resp.status,
+			resp.body,
+		)
+		if err != nil {
+			return storedResponse{}, fmt.Errorf("failed to update idempotency_keys: %w", err)
+		}
+	}
+
+	// Notify workers that listen for new messages. The notification is delivered when the transaction commits.
+
+	if _, err = tx.Exec(ctx, `SELECT pg_notify($1, '')`, outbox.Channel); err != nil {
+		return storedResponse{}, fmt.Errorf("failed to notify %s: %w", outbox.Channel, err)
 	}
 
 	if err = tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return storedResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
 	}
-	return nil
+	return resp, nil
+}
+
+// claimIdempotencyKey claims the idempotency key for the request in tx.
+// It returns nil if the key is unused or was last used before the idempotency window, and the stored response of the
+// request that used the key otherwise. It returns errIdempotencyKeyReused if that request was different.
+func (h *handler) claimIdempotencyKey(ctx context.Context, tx pgx.Tx, idemKey idempotencyKey) (*storedResponse, error) {
+	tag, err := tx.Exec(
+		ctx,
+		`
+			INSERT INTO idempotency_keys (client, key, request_hash)
+			VALUES (@client, @key, @requestHash)
+			ON CONFLICT (client, key) DO UPDATE
+			SET created_at = now(), request_hash = excluded.request_hash, response_status = NULL, response_body = NULL
+			WHERE idempotency_keys.created_at < now() - @windowMilliseconds * interval '1 millisecond'
+		`,
+		pgx.NamedArgs{
+			"client":             idemKey.client,
+			"key":                idemKey.key,
+			"requestHash":        idemKey.requestHash,
+			"windowMilliseconds": h.idempotencyWindow.Milliseconds(),
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert into idempotency_keys: %w", err)
+	}
+	if tag.RowsAffected() == 1 {
+		return nil, nil
+	}
+
+	var requestHash []byte
+	var status *int
+	var body []byte
+	err = tx.QueryRow(
+		ctx,
+		`SELECT request_hash, response_status, response_body FROM idempotency_keys WHERE client = $1 AND key = $2`,
+		idemKey.client,
+		idemKey.key,
+	).Scan(&requestHash, &status, &body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query idempotency_keys: %w", err)
+	}
+	if !bytes.Equal(requestHash, idemKey.requestHash) {
+		return nil, errIdempotencyKeyReused
+	}
+	if status == nil {
+		return nil, fmt.Errorf("idempotency key has no stored response")
+	}
+	return &storedResponse{status: *status, body: body, replayed: true}, nil
 }
 
 type getStatisticsResponse struct {
-	CountInMessageInfos              int `json:"count_in_message_infos"`
-	UndeliveredCountInOutboxMessages int `json:"undelivered_count_in_outbox_messages"`
-	DeliveredCountInOutboxMessages   int `json:"delivered_count_in_outbox_messages"`
+	CountInMessageInfos                   int `json:"count_in_message_infos"`
+	ScheduledCountInOutboxMessages        int `json:"scheduled_count_in_outbox_messages"`
+	UndeliveredCountInOutboxMessages      int `json:"undelivered_count_in_outbox_messages"`
+	ClaimedCountInOutboxMessages          int `json:"claimed_count_in_outbox_messages"`
+	DeliveredCountInOutboxMessages        int `json:"delivered_count_in_outbox_messages"`
+	DeadCountInOutboxMessages             int `json:"dead_count_in_outbox_messages"`
+	ExpiredCountInOutboxMessages          int `json:"expired_count_in_outbox_messages"`
+	RemovedDeliveredCountInOutboxMessages int `json:"removed_delivered_count_in_outbox_messages"`
+	RemovedDeadCountInOutboxMessages      int `json:"removed_dead_count_in_outbox_messages"`
+	RemovedExpiredCountInOutboxMessages   int `json:"removed_expired_count_in_outbox_messages"`
 }
 
 func (h *handler) handleGetStatistics(w http.ResponseWriter, r *http.Request) {
@@ -162,19 +369,40 @@ func (h *handler) getStatistics(ctx context.Context) (*getStatisticsResponse, er
 			SELECT
 				(SELECT COUNT(*) FROM message_infos) AS count_in_message_infos,
 				(SELECT COUNT(*) FROM outbox_messages WHERE status = $1) AS undelivered_count_in_outbox_messages,
-				(SELECT COUNT(*) FROM outbox_messages WHERE status = $2) AS delivered_count_in_outbox_messages
+				(SELECT COUNT(*) FROM outbox_messages WHERE status = $2) AS claimed_count_in_outbox_messages,
+				(SELECT COUNT(*) FROM outbox_messages WHERE status = $3) AS delivered_count_in_outbox_messages,
+				(SELECT COUNT(*) FROM outbox_messages WHERE status = $4) AS dead_count_in_outbox_messages,
+				(SELECT COALESCE(SUM(removed_count), 0)::bigint FROM outbox_retention_counts WHERE status = $3)
+					AS removed_delivered_count_in_outbox_messages,
+				(SELECT COALESCE(SUM(removed_count), 0)::bigint FROM outbox_retention_counts WHERE status = $4)
+					AS removed_dead_count_in_outbox_messages,
+				(SELECT COUNT(*) FROM outbox_messages WHERE status = $5) AS scheduled_count_in_outbox_messages,
+				(SELECT COUNT(*) FROM outbox_messages WHERE status = $6) AS expired_count_in_outbox_messages,
+				(SELECT COALESCE(SUM(removed_count), 0)::bigint FROM outbox_retention_counts WHERE status = $6)
+					AS removed_expired_count_in_outbox_messages
 		`,
 		outbox.StatusUndelivered,
+		outbox.StatusClaimed,
 		outbox.StatusDelivered,
+		outbox.StatusDead,
+		outbox.StatusScheduled,
+		outbox.StatusExpired,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query statistics: %w", err)
 	}
 
 	type row struct {
-		CountInMessageInfos              int `db:"count_in_message_infos"`
-		UndeliveredCountInOutboxMessages int `db:"undelivered_count_in_outbox_messages"`
-		DeliveredCountInOutboxMessages   int `db:"delivered_count_in_outbox_messages"`
+		CountInMessageInfos                   int `db:"count_in_message_infos"`
+		ScheduledCountInOutboxMessages        int `db:"scheduled_count_in_outbox_messages"`
+		UndeliveredCountInOutboxMessages      int `db:"undelivered_count_in_outbox_messages"`
+		ClaimedCountInOutboxMessages          int `db:"claimed_count_in_outbox_messages"`
+		DeliveredCountInOutboxMessages        int `db:"delivered_count_in_outbox_messages"`
+		DeadCountInOutboxMessages             int `db:"dead_count_in_outbox_messages"`
+		ExpiredCountInOutboxMessages          int `db:"expired_count_in_outbox_messages"`
+		RemovedDeliveredCountInOutboxMessages int `db:"removed_delivered_count_in_outbox_messages"`
+		RemovedDeadCountInOutboxMessages      int `db:"removed_dead_count_in_outbox_messages"`
+		RemovedExpiredCountInOutboxMessages   int `db:"removed_expired_count_in_outbox_messages"`
 	}
 	r, err := pgx.CollectExactlyOneRow(result, pgx.RowToStructByName[row])
 	if err != nil {
@@ -182,8 +410,15 @@ func (h *handler) getStatistics(ctx context.Context) (*getStatisticsResponse, er
 	}
 
 	return &getStatisticsResponse{
-		CountInMessageInfos:              r.CountInMessageInfos,
-		UndeliveredCountInOutboxMessages: r.UndeliveredCountInOutboxMessages,
-		DeliveredCountInOutboxMessages:   r.DeliveredCountInOutboxMessages,
+		CountInMessageInfos:                   r.CountInMessageInfos,
+		ScheduledCountInOutboxMessages:        r.ScheduledCountInOutboxMessages,
+		UndeliveredCountInOutboxMessages:      r.UndeliveredCountInOutboxMessages,
+		ClaimedCountInOutboxMessages:          r.ClaimedCountInOutboxMessages,
+		DeliveredCountInOutboxMessages:        r.DeliveredCountInOutboxMessages,
+		DeadCountInOutboxMessages:             r.DeadCountInOutboxMessages,
+		ExpiredCountInOutboxMessages:          r.ExpiredCountInOutboxMessages,
+		RemovedDeliveredCountInOutboxMessages: r.RemovedDeliveredCountInOutboxMessages,
+		RemovedDeadCountInOutboxMessages:      r.RemovedDeadCountInOutboxMessages,
+		RemovedExpiredCountInOutboxMessages:   r.RemovedExpiredCountInOutboxMessages,
 	}, nil
 }
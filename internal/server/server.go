@@ -8,15 +8,18 @@ import (
 	"strconv"
 
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/segmentio/kafka-go"
 )
 
 // New returns a new HTTP server.
 // It should be started with a listener returned by Listen.
-func New(cfg Config, log *slog.Logger, kafkaWriter *kafka.Writer, postgresPool *pgxpool.Pool) *http.Server {
+func New(cfg Config, log *slog.Logger, postgresPool *pgxpool.Pool) *http.Server {
 	mux := http.NewServeMux()
 
-	h := &handler{log: log, kafkaWriter: kafkaWriter, postgresPool: postgresPool}
+	h := &handler{
+		idempotencyWindow: cfg.idempotencyWindow(),
+		log:               log,
+		postgresPool:      postgresPool,
+	}
 	mux.HandleFunc("GET /health", h.handleGetHealth)
 	mux.HandleFunc("POST /messages", h.handleCreateMessage)
 	mux.HandleFunc("GET /statistics", h.handleGetStatistics)
@@ -1,12 +1,18 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/postgrestest"
 )
 
 func TestGetHealth(t *testing.T) {
@@ -14,8 +20,8 @@ func TestGetHealth(t *testing.T) {
 		req := httptest.NewRequest("GET", "/health", nil)
 		rec := httptest.NewRecorder()
 
-		// FIXME: Config is empty, kafkaWriter and postgresPool are nil.
-		srv := New(Config{}, slog.Default(), nil, nil)
+		// FIXME: Config is empty, postgresPool is nil.
+		srv := New(Config{}, slog.Default(), nil)
 		srv.Handler.ServeHTTP(rec, req)
 
 		if got, want := rec.Code, http.StatusOK; got != want {
@@ -27,6 +33,111 @@ func TestGetHealth(t *testing.T) {
 	})
 }
 
+func TestCreateMessage(t *testing.T) {
+	t.Run("Replays the response for a reused idempotency key", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		srv := New(Config{}, slog.Default(), pool)
+		body := `{"topic": "example", "key": "a-key", "value": "a-value"}`
+
+		first := createMessage(srv, body, "client-a", "key-1")
+		if got, want := first.Code, http.StatusCreated; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		second := createMessage(srv, body, "client-a", "key-1")
+		if got, want := second.Code, http.StatusCreated; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+
+		if got, want := second.Body.String(), first.Body.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got, want := second.Header().Get(idempotencyReplayedHeader), "true"; got != want {
+			t.Errorf("got %q %s header, want %q", got, idempotencyReplayedHeader, want)
+		}
+		if got, want := countRows(t, pool, "outbox_messages"), 1; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Scopes idempotency keys per client", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		srv := New(Config{}, slog.Default(), pool)
+		body := `{"topic": "example", "key": "a-key", "value": "a-value"}`
+
+		createMessage(srv, body, "client-a", "key-1")
+		rec := createMessage(srv, body, "client-b", "key-1")
+
+		if got, want := rec.Header().Get(idempotencyReplayedHeader), ""; got != want {
+			t.Errorf("got %q %s header, want %q", got, idempotencyReplayedHeader, want)
+		}
+		if got, want := countRows(t, pool, "outbox_messages"), 2; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Returns bad request for an idempotency key without a client", func(t *testing.T) {
+		// FIXME: Config is empty, postgresPool is nil.
+		srv := New(Config{}, slog.Default(), nil)
+
+		rec := createMessage(srv, `{"topic": "example", "key": "a-key", "value": "a-value"}`, "", "key-1")
+
+		if got, want := rec.Code, http.StatusBadRequest; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Returns conflict for an idempotency key reused with a different request", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		srv := New(Config{}, slog.Default(), pool)
+
+		createMessage(srv, `{"topic": "example", "key": "a-key", "value": "a-value"}`, "client-a", "key-1")
+		rec := createMessage(srv, `{"topic": "example", "key": "a-key", "value": "b-value"}`, "client-a", "key-1")
+
+		if got, want := rec.Code, http.StatusConflict; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := countRows(t, pool, "outbox_messages"), 1; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Creates a message again after the idempotency window", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		srv := New(Config{IdempotencyWindow: time.Nanosecond}, slog.Default(), pool)
+		body := `{"topic": "example", "key": "a-key", "value": "a-value"}`
+
+		createMessage(srv, body, "client-a", "key-1")
+		time.Sleep(time.Millisecond)
+		rec := createMessage(srv, body, "client-a", "key-1")
+
+		if got, want := rec.Code, http.StatusCreated; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := countRows(t, pool, "outbox_messages"), 2; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+	})
+}
+
+func createMessage(srv *http.Server, body, clientID, idempotencyKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/messages", strings.NewReader(body))
+	req.Header.Set(clientIDHeader, clientID)
+	req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func countRows(t *testing.T, pool *pgxpool.Pool, table string) int {
+	t.Helper()
+
+	var count int
+	if err := pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM "+table).Scan(&count); err != nil {
+		t.Fatalf("failed to count rows: %v", err)
+	}
+	return count
+}
+
 func equalJSON(x, y string) bool {
 	var mx, my any
 	if err := json.Unmarshal([]byte(x), &mx); err != nil {
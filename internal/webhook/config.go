@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Config holds the webhook configuration.
+// The zero value is a valid configuration.
+type Config struct {
+	Enabled         bool          `env:"ENABLED"`          // send the topics of the endpoints to webhooks instead of Kafka
+	Endpoints       Endpoints     `env:"ENDPOINTS"`        // JSON array of endpoints, see Endpoint
+	MaxAttempts     int           `env:"MAX_ATTEMPTS"`     // default: 3, attempts to deliver a message per batch
+	MaxRetryAfter   time.Duration `env:"MAX_RETRY_AFTER"`  // default: 5s, longer Retry-After is left to the worker
+	RetryInterval   time.Duration `env:"RETRY_INTERVAL"`   // default: 1s, used when a response has no Retry-After
+	SignatureHeader string        `env:"SIGNATURE_HEADER"` // default: "Webhook-Signature"
+	TimestampHeader string        `env:"TIMESTAMP_HEADER"` // default: "Webhook-Timestamp"
+	Timeout         time.Duration `env:"TIMEOUT"`          // default: 10s, for endpoints without their own timeout
+}
+
+// Endpoint is a webhook that receives the messages of a topic.
+type Endpoint struct {
+	Topic   string        // required
+	URL     string        // required, http or https
+	Secret  string        // required, signs deliveries
+	Timeout time.Duration // optional, the timeout of the configuration if zero
+}
+
+// UnmarshalJSON parses an endpoint from an object such as
+// {"topic": "orders", "url": "https://example.com/hook", "secret": "...", "timeout": "5s"}.
+func (e *Endpoint) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Topic   string `json:"topic"`
+		URL     string `json:"url"`
+		Secret  string `json:"secret"`
+		Timeout string `json:"timeout"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	var timeout time.Duration
+	if v.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(v.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout of topic %q: %w", v.Topic, err)
+		}
+	}
+
+	*e = Endpoint{Topic: v.Topic, URL: v.URL, Secret: v.Secret, Timeout: timeout}
+	return nil
+}
+
+// Endpoints is a list of endpoints that is parsed from a JSON array.
+type Endpoints []Endpoint
+
+// UnmarshalText parses endpoints from a JSON array.
+func (e *Endpoints) UnmarshalText(text []byte) error {
+	var endpoints []Endpoint
+	if err := json.Unmarshal(text, &endpoints); err != nil {
+		return fmt.Errorf("failed to parse endpoints: %w", err)
+	}
+	*e = endpoints
+	return nil
+}
+
+// Topics returns the topics of the endpoints.
+func (c Config) Topics() []string {
+	topics := make([]string, len(c.Endpoints))
+	for i, e := range c.Endpoints {
+		topics[i] = e.Topic
+	}
+	return topics
+}
+
+func (c Config) validate() error {
+	topics := make(map[string]bool)
+	for _, e := range c.Endpoints {
+		if e.Topic == "" {
+			return fmt.Errorf("endpoint %q has no topic", e.URL)
+		}
+		if topics[e.Topic] {
+			return fmt.Errorf("topic %q has more than one endpoint", e.Topic)
+		}
+		topics[e.Topic] = true
+
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint of topic %q has invalid URL %q", e.Topic, e.URL)
+		}
+		if e.Secret == "" {
+			return fmt.Errorf("endpoint of topic %q has no secret", e.Topic)
+		}
+		if e.Timeout < 0 {
+			return fmt.Errorf("endpoint of topic %q has negative timeout %v", e.Topic, e.Timeout)
+		}
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts %d is negative", c.MaxAttempts)
+	}
+	return nil
+}
+
+func (c Config) maxAttempts() int {
+	a := c.MaxAttempts
+	if a == 0 {
+		a = 3
+	}
+	return a
+}
+
+func (c Config) maxRetryAfter() time.Duration {
+	d := c.MaxRetryAfter
+	if d == 0 {
+		d = 5 * time.Second
+	}
+	return d
+}
+
+func (c Config) retryInterval() time.Duration {
+	i := c.RetryInterval
+	if i == 0 {
+		i = time.Second
+	}
+	return i
+}
+
+func (c Config) signatureHeader() string {
+	h := c.SignatureHeader
+	if h == "" {
+		h = "Webhook-Signature"
+	}
+	return h
+}
+
+func (c Config) timestampHeader() string {
+	h := c.TimestampHeader
+	if h == "" {
+		h = "Webhook-Timestamp"
+	}
+	return h
+}
+
+func (c Config) timeout(e Endpoint) time.Duration {
+	t := e.Timeout
+	if t == 0 {
+		t = c.Timeout
+	}
+	if t == 0 {
+		t = 10 * time.Second
+	}
+	return t
+}
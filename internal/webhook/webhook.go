@@ -0,0 +1,221 @@
+// Package webhook publishes outbox messages to webhook endpoints over HTTP.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// maxDiscardedBodySize is the size of a response body that is read to reuse the connection.
+const maxDiscardedBodySize = 64 << 10
+
+// Publisher posts messages to the endpoints of their topics.
+// It should be created with NewPublisher.
+type Publisher struct {
+	cfg       Config
+	log       *slog.Logger
+	client    *http.Client
+	endpoints map[string]Endpoint
+	now       func() time.Time
+}
+
+// NewPublisher creates a new Publisher.
+// It returns an error if the configuration is invalid.
+func NewPublisher(cfg Config, log *slog.Logger) (*Publisher, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	endpoints := make(map[string]Endpoint, len(cfg.Endpoints))
+	for _, e := range cfg.Endpoints {
+		endpoints[e.Topic] = e
+	}
+
+	return &Publisher{
+		cfg:       cfg,
+		log:       log.With("component", "webhook"),
+		client:    &http.Client{},
+		endpoints: endpoints,
+		now:       time.Now,
+	}, nil
+}
+
+// Publish posts each message to the endpoint of its topic.
+// Messages with the same topic and key are posted one after another in order, others are posted concurrently.
+// A message is posted again on a network error or a 5xx or 429 response, after the Retry-After of the response or else
+// the retry interval, up to the max attempts. It returns the error of each message, which is nil for messages that got
+// a 2xx response.
+func (p *Publisher) Publish(ctx context.Context, msgs []outbox.Message) []error {
+	errs := make([]error, len(msgs))
+
+	type groupKey struct{ topic, key string }
+	groups := make(map[groupKey][]int)
+	var keys []groupKey
+	for i, m := range msgs {
+		k := groupKey{m.Topic, string(m.Key)}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], i)
+	}
+
+	var wg sync.WaitGroup
+	for _, k := range keys {
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+			for _, i := range indexes {
+				errs[i] = p.deliver(ctx, msgs[i])
+			}
+		}(groups[k])
+	}
+	wg.Wait()
+	return errs
+}
+
+// Close closes the idle connections to the endpoints.
+func (p *Publisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// deliver posts m to the endpoint of its topic and retries it while it fails with a retryable error.
+func (p *Publisher) deliver(ctx context.Context, m outbox.Message) error {
+	e, ok := p.endpoints[m.Topic]
+	if !ok {
+		return fmt.Errorf("no endpoint for topic %q", m.Topic)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := p.post(ctx, e, m)
+		if err == nil {
+			return nil
+		}
+
+		// A post that can't be retried before the batch times out is left to the worker.
+		delay, retryable := p.retryDelay(err)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			retryable = false
+		}
+		if !retryable || attempt >= p.cfg.maxAttempts() || ctx.Err() != nil {
+			return err
+		}
+		p.log.Warn("failed to post message, retrying", "topic", m.Topic, "attempt", attempt, "retry_in", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// post posts m to e once.
+// The body is the value of m, and the headers of m become request headers. The request is signed with the secret of
+// e over the timestamp and the body, see signature.
+func (p *Publisher) post(ctx context.Context, e Endpoint, m outbox.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.timeout(e))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(m.Value))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for _, h := range m.Headers {
+		req.Header.Add(h.Key, string(h.Value))
+	}
+	timestamp := strconv.FormatInt(p.now().Unix(), 10)
+	req.Header.Set(p.cfg.timestampHeader(), timestamp)
+	req.Header.Set(p.cfg.signatureHeader(), signature(e.Secret, timestamp, m.Value))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post message: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxDiscardedBodySize))
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), p.now()),
+		}
+	}
+	return nil
+}
+
+// retryDelay reports whether a post that failed with err should be retried and how long to wait before it.
+// Network errors and 5xx and 429 responses are retried. A response that asks to wait longer than the max Retry-After
+// isn't retried, so that the worker retries it later.
+func (p *Publisher) retryDelay(err error) (time.Duration, bool) {
+	var statusErr *statusError
+	if !errors.As(err, &statusErr) {
+		return p.cfg.retryInterval(), true
+	}
+	if statusErr.StatusCode != http.StatusTooManyRequests && statusErr.StatusCode < 500 {
+		return 0, false
+	}
+	if statusErr.RetryAfter < 0 {
+		return p.cfg.retryInterval(), true
+	}
+	if statusErr.RetryAfter > p.cfg.maxRetryAfter() {
+		return 0, false
+	}
+	return statusErr.RetryAfter, true
+}
+
+// statusError is returned when an endpoint responds with a status other than 2xx.
+type statusError struct {
+	StatusCode int
+	RetryAfter time.Duration // negative if the response has no valid Retry-After
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("endpoint responded with status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date.
+// It returns a negative duration if the value is empty or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return -1
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return -1
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return -1
+}
+
+// signature returns the signature of a delivery with the given timestamp and body.
+// It is "sha256=" followed by the hex-encoded HMAC-SHA256 of the timestamp, a dot and the body, keyed with secret.
+// Receivers should compute it the same way, compare it in constant time, and reject old timestamps.
+func signature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,358 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+func TestPublish(t *testing.T) {
+	t.Run("Posts signed messages to the endpoints of their topics", func(t *testing.T) {
+		var req request
+		srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+			req = newRequest(t, r)
+			w.WriteHeader(http.StatusNoContent)
+		})
+		p := newTestPublisher(t, Config{}, Endpoint{Topic: "orders", URL: srv.URL, Secret: "secret"})
+		p.now = func() time.Time { return time.Unix(1720614645, 0) }
+
+		errs := p.Publish(context.Background(), []outbox.Message{{
+			Topic:   "orders",
+			Key:     []byte("a-key"),
+			Value:   []byte(`{"id":1}`),
+			Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+		}})
+
+		if errs[0] != nil {
+			t.Fatalf("got %v error, want nil", errs[0])
+		}
+		if got, want := req.body, `{"id":1}`; got != want {
+			t.Errorf("got %q body, want %q", got, want)
+		}
+		if got, want := req.header.Get("Content-Type"), "application/json"; got != want {
+			t.Errorf("got %q content type, want %q", got, want)
+		}
+		if got, want := req.header.Get("Webhook-Timestamp"), "1720614645"; got != want {
+			t.Errorf("got %q timestamp, want %q", got, want)
+		}
+		wantSignature := signature("secret", "1720614645", []byte(`{"id":1}`))
+		if got, want := req.header.Get("Webhook-Signature"), wantSignature; got != want {
+			t.Errorf("got %q signature, want %q", got, want)
+		}
+	})
+
+	t.Run("Signs the timestamp and the body with HMAC-SHA256", func(t *testing.T) {
+		got := signature("secret", "1720614645", []byte(`{"id":1}`))
+
+		// echo -n '1720614645.{"id":1}' | openssl dgst -sha256 -hmac secret
+		if want := "sha256=02084af6f81fc9ad9f74c2c5483dd96433b95a06e7aa9c995572858a79fc0d3c"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Retries 5xx and 429 responses honoring Retry-After", func(t *testing.T) {
+		srv := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, n int) {
+			switch n {
+			case 1:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case 2:
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
+		})
+		cfg := Config{RetryInterval: time.Millisecond}
+		p := newTestPublisher(t, cfg, Endpoint{Topic: "orders", URL: srv.URL, Secret: "s"})
+
+		errs := p.Publish(context.Background(), []outbox.Message{{Topic: "orders"}})
+
+		if errs[0] != nil {
+			t.Errorf("got %v error, want nil", errs[0])
+		}
+		if got, want := srv.count(), 3; got != want {
+			t.Errorf("got %d requests, want %d", got, want)
+		}
+	})
+
+	t.Run("Retries network errors after the retry interval", func(t *testing.T) {
+		srv := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, n int) {
+			if n == 1 {
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					t.Errorf("failed to hijack connection: %v", err)
+					return
+				}
+				_ = conn.Close()
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		cfg := Config{RetryInterval: 200 * time.Millisecond}
+		p := newTestPublisher(t, cfg, Endpoint{Topic: "orders", URL: srv.URL, Secret: "s"})
+
+		start := time.Now()
+		errs := p.Publish(context.Background(), []outbox.Message{{Topic: "orders"}})
+
+		if errs[0] != nil {
+			t.Errorf("got %v error, want nil", errs[0])
+		}
+		if elapsed := time.Since(start); elapsed < cfg.RetryInterval {
+			t.Errorf("got %v elapsed, want at least %v", elapsed, cfg.RetryInterval)
+		}
+		if got, want := srv.count(), 2; got != want {
+			t.Errorf("got %d requests, want %d", got, want)
+		}
+	})
+
+	t.Run("Fails after max attempts", func(t *testing.T) {
+		srv := newTestServer(t, func(w http.ResponseWriter, _ *http.Request, _ int) {
+			w.WriteHeader(http.StatusBadGateway)
+		})
+		cfg := Config{MaxAttempts: 2, RetryInterval: time.Millisecond}
+		p := newTestPublisher(t, cfg, Endpoint{Topic: "orders", URL: srv.URL, Secret: "s"})
+
+		errs := p.Publish(context.Background(), []outbox.Message{{Topic: "orders"}})
+
+		var statusErr *statusError
+		if !errors.As(errs[0], &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+			t.Errorf("got %v error, want status %d", errs[0], http.StatusBadGateway)
+		}
+		if got, want := srv.count(), 2; got != want {
+			t.Errorf("got %d requests, want %d", got, want)
+		}
+	})
+
+	t.Run("Doesn't retry 4xx responses or Retry-After beyond the maximum", func(t *testing.T) {
+		srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+			if r.URL.Path == "/busy" {
+				w.Header().Set("Retry-After", "3600")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+		})
+		p := newTestPublisher(
+			t,
+			Config{RetryInterval: time.Millisecond},
+			Endpoint{Topic: "orders", URL: srv.URL + "/bad", Secret: "s"},
+			Endpoint{Topic: "payments", URL: srv.URL + "/busy", Secret: "s"},
+		)
+
+		errs := p.Publish(context.Background(), []outbox.Message{{Topic: "orders"}, {Topic: "payments"}})
+
+		if errs[0] == nil || errs[1] == nil {
+			t.Errorf("got %v errors, want non-nil", errs)
+		}
+		if got, want := srv.count(), 2; got != want {
+			t.Errorf("got %d requests, want %d", got, want)
+		}
+	})
+
+	t.Run("Doesn't wait for Retry-After beyond the deadline of the batch", func(t *testing.T) {
+		srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+		p := newTestPublisher(t, Config{}, Endpoint{Topic: "orders", URL: srv.URL, Secret: "s"})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		start := time.Now()
+		errs := p.Publish(ctx, []outbox.Message{{Topic: "orders"}})
+
+		if errs[0] == nil {
+			t.Errorf("got nil error, want non-nil")
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("got %v elapsed, want less than 500ms", elapsed)
+		}
+		if got, want := srv.count(), 1; got != want {
+			t.Errorf("got %d requests, want %d", got, want)
+		}
+	})
+
+	t.Run("Applies the timeout of the endpoint", func(t *testing.T) {
+		srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		cfg := Config{MaxAttempts: 1, Timeout: time.Hour}
+		p := newTestPublisher(t, cfg, Endpoint{Topic: "orders", URL: srv.URL, Secret: "s", Timeout: 10 * time.Millisecond})
+
+		errs := p.Publish(context.Background(), []outbox.Message{{Topic: "orders"}})
+
+		if got, want := errs[0], context.DeadlineExceeded; !errors.Is(got, want) {
+			t.Errorf("got %v error, want %v", got, want)
+		}
+	})
+
+	t.Run("Posts messages with the same key in order and fails topics without an endpoint", func(t *testing.T) {
+		var mu sync.Mutex
+		var bodies []string
+		srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request, _ int) {
+			req := newRequest(t, r)
+			mu.Lock()
+			bodies = append(bodies, req.body)
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+		})
+		p := newTestPublisher(t, Config{}, Endpoint{Topic: "orders", URL: srv.URL, Secret: "s"})
+
+		errs := p.Publish(context.Background(), []outbox.Message{
+			{Topic: "orders", Key: []byte("a"), Value: []byte("a-0")},
+			{Topic: "missing", Key: []byte("a"), Value: []byte("b-0")},
+			{Topic: "orders", Key: []byte("a"), Value: []byte("a-1")},
+		})
+
+		if errs[0] != nil || errs[2] != nil {
+			t.Errorf("got %v errors, want nil for orders", errs)
+		}
+		if errs[1] == nil {
+			t.Errorf("got nil error for topic without an endpoint, want non-nil")
+		}
+		if got, want := bodies, []string{"a-0", "a-1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestNewPublisher(t *testing.T) {
+	t.Run("Parses endpoints from the environment", func(t *testing.T) {
+		var cfg Config
+		err := env.ParseWithOptions(&cfg, env.Options{Environment: map[string]string{
+			"ENDPOINTS": `[{"topic": "orders", "url": "https://example.com/hook?a=b", "secret": "c2VjcmV0", "timeout": "5s"}]`,
+		}})
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		want := Endpoints{{Topic: "orders", URL: "https://example.com/hook?a=b", Secret: "c2VjcmV0", Timeout: 5 * time.Second}}
+		if got := cfg.Endpoints; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+		if _, err = NewPublisher(cfg, slog.Default()); err != nil {
+			t.Errorf("got %v error, want nil", err)
+		}
+	})
+
+	tests := []struct {
+		name      string
+		endpoints Endpoints
+	}{
+		{name: "Rejects endpoints without a topic", endpoints: Endpoints{{URL: "https://example.com", Secret: "s"}}},
+		{name: "Rejects endpoints without a secret", endpoints: Endpoints{{Topic: "a", URL: "https://example.com"}}},
+		{
+			name:      "Rejects endpoints with an invalid URL",
+			endpoints: Endpoints{{Topic: "a", URL: "example.com", Secret: "s"}},
+		},
+		{
+			name: "Rejects topics with several endpoints",
+			endpoints: Endpoints{
+				{Topic: "a", URL: "https://example.com/1", Secret: "s"},
+				{Topic: "a", URL: "https://example.com/2", Secret: "s"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPublisher(Config{Endpoints: tt.endpoints}, slog.Default()); err == nil {
+				t.Errorf("got nil error, want non-nil")
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 7, 10, 12, 30, 45, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: -1},
+		{value: "5", want: 5 * time.Second},
+		{value: "-5", want: -1},
+		{value: "Wed, 10 Jul 2024 12:31:00 GMT", want: 15 * time.Second},
+		{value: "Wed, 10 Jul 2024 12:00:00 GMT", want: 0},
+		{value: "soon", want: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run("Parses "+tt.value, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value, now); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type request struct {
+	header http.Header
+	body   string
+}
+
+func newRequest(t *testing.T, r *http.Request) request {
+	t.Helper()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Errorf("failed to read request body: %v", err)
+	}
+	return request{header: r.Header, body: string(body)}
+}
+
+// testServer is an httptest.Server that counts requests.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests int
+}
+
+// newTestServer starts a server that handles the nth request, counting from 1, with handle.
+func newTestServer(t *testing.T, handle func(w http.ResponseWriter, r *http.Request, n int)) *testServer {
+	t.Helper()
+
+	srv := &testServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		srv.requests++
+		n := srv.requests
+		srv.mu.Unlock()
+		handle(w, r, n)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (s *testServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newTestPublisher(t *testing.T, cfg Config, endpoints ...Endpoint) *Publisher {
+	t.Helper()
+
+	cfg.Endpoints = endpoints
+	p, err := NewPublisher(cfg, slog.Default())
+	if err != nil {
+		t.Fatalf("failed to create publisher: %v", err)
+	}
+	t.Cleanup(func() { _ = p.Close() })
+	return p
+}
@@ -0,0 +1,452 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+const (
+	// cdcStatusInterval is how often the confirmed position is reported to Postgres.
+	cdcStatusInterval = 10 * time.Second
+	// cdcFlushDelay is how long inserted messages are collected before they are sent if the batch isn't full.
+	cdcFlushDelay = 100 * time.Millisecond
+)
+
+// SetupCDC creates the publication and the logical replication slot used in change data capture mode unless they
+// already exist. Postgres must run with wal_level=logical.
+func SetupCDC(ctx context.Context, conn *pgx.Conn, cfg CDCConfig) error {
+	var exists bool
+
+	err := conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)`, cfg.publication()).
+		Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query pg_publication: %w", err)
+	}
+	if !exists {
+		// Changes of a partitioned outbox_messages are published as changes of outbox_messages itself.
+		_, err = conn.Exec(ctx, fmt.Sprintf(
+			`
+				CREATE PUBLICATION %s FOR TABLE outbox_messages
+				WITH (publish = 'insert', publish_via_partition_root = true)
+			`,
+			pgx.Identifier{cfg.publication()}.Sanitize(),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to create publication: %w", err)
+		}
+	}
+
+	// outbox_messages is dropped from the publication when it is recreated, e.g. when it is partitioned.
+	err = conn.QueryRow(
+		ctx,
+		`
+			SELECT EXISTS (
+				SELECT 1
+				FROM pg_publication_rel pr
+				JOIN pg_publication p ON p.oid = pr.prpubid
+				WHERE p.pubname = $1 AND pr.prrelid = 'outbox_messages'::regclass
+			)
+		`,
+		cfg.publication(),
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query pg_publication_rel: %w", err)
+	}
+	if !exists {
+		_, err = conn.Exec(ctx, fmt.Sprintf(
+			`ALTER PUBLICATION %s ADD TABLE outbox_messages`,
+			pgx.Identifier{cfg.publication()}.Sanitize(),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to add outbox_messages to publication: %w", err)
+		}
+		_, err = conn.Exec(ctx, fmt.Sprintf(
+			`ALTER PUBLICATION %s SET (publish = 'insert', publish_via_partition_root = true)`,
+			pgx.Identifier{cfg.publication()}.Sanitize(),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to alter publication: %w", err)
+		}
+	}
+
+	err = conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, cfg.slot()).
+		Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to query pg_replication_slots: %w", err)
+	}
+	if !exists {
+		_, err = conn.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'pgoutput')`, cfg.slot())
+		if err != nil {
+			return fmt.Errorf("failed to create replication slot: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// runCDC runs the worker in change data capture mode.
+// Instead of polling outbox_messages, it reads inserted messages from the logical replication stream, sends them to
+// the broker, records the results and only then confirms their position to Postgres. It restarts the stream from the
+// last confirmed position after an error. Messages that failed to be sent are retried by polling every interval.
+// Before it starts, it sends the messages that the stream doesn't contain, see backfill.
+// It stops when ctx is canceled.
+func (w *Worker) runCDC(ctx context.Context) {
+	if !w.backfill(ctx) {
+		return
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.loop(ctx, func() bool {
+			w.sendBatch(ctx)
+			return true
+		})
+	}()
+
+	for {
+		err := w.streamChanges(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		w.log.Error("failed to stream changes", "error", err)
+
+		select {
+		case <-time.After(w.cfg.interval()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// backfill sends undelivered messages by polling until none are left.
+// The replication stream only contains messages committed after the confirmed position of the slot, so messages
+// inserted before the slot was created or while the worker ran without change data capture would never be sent
+// otherwise. Messages that are in the stream too are sent once, because flushChanges skips messages that were sent.
+// It reports whether it finished before ctx was canceled.
+func (w *Worker) backfill(ctx context.Context) bool {
+	for ctx.Err() == nil {
+		batchCtx, cancel := w.batchContext(ctx)
+		count, err := w.sendMessages(batchCtx)
+		cancel()
+		if err != nil {
+			w.log.Error("failed to backfill messages", "error", err)
+			select {
+			case <-time.After(w.cfg.interval()):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if count > 0 {
+			w.log.Info("backfilled messages", "count", count)
+		}
+
+		// The worker is woken up after a full batch, when more messages are likely waiting.
+		select {
+		case <-w.wake:
+		default:
+			w.backfilled = true
+			return true
+		}
+	}
+	return false
+}
+
+// cdcStream holds the state of a logical replication stream.
+type cdcStream struct {
+	conn      *pgconn.PgConn
+	typeMap   *pgtype.Map
+	relations map[uint32]*pglogrepl.RelationMessage
+
+	inTx         bool          // whether a transaction is being received
+	txMessages   []message     // inserted in the current transaction
+	pending      []message     // inserted in committed transactions but not sent yet
+	pendingLSN   pglogrepl.LSN // end of the last transaction with pending messages
+	flushAt      time.Time     // when pending messages are sent if the batch isn't full
+	confirmedLSN pglogrepl.LSN // position before which every message was sent
+	statusAt     time.Time     // when the confirmed position is reported next
+}
+
+// streamChanges streams changes from the replication slot until an error occurs or ctx is canceled.
+func (w *Worker) streamChanges(ctx context.Context) error {
+	connCfg := w.postgresPool.Config().ConnConfig.Config.Copy()
+	connCfg.RuntimeParams["replication"] = "database"
+
+	conn, err := pgconn.ConnectConfig(ctx, connCfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect for replication: %w", err)
+	}
+	defer func() {
+		_ = conn.Close(context.Background())
+	}()
+
+	err = pglogrepl.StartReplication(ctx, conn, w.cfg.CDC.slot(), 0, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{
+			"proto_version '1'",
+			fmt.Sprintf("publication_names '%s'", strings.ReplaceAll(w.cfg.CDC.publication(), "'", "''")),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start replication: %w", err)
+	}
+	w.log.Info("started replication", "slot", w.cfg.CDC.slot(), "publication", w.cfg.CDC.publication())
+
+	s := &cdcStream{
+		conn:      conn,
+		typeMap:   pgtype.NewMap(),
+		relations: make(map[uint32]*pglogrepl.RelationMessage),
+	}
+	for {
+		if err = w.receiveChange(ctx, s); err != nil {
+			return err
+		}
+	}
+}
+
+// receiveChange receives and handles one replication message.
+// It sends pending messages when the batch is full or the flush delay has passed, and reports the confirmed position
+// every status interval.
+func (w *Worker) receiveChange(ctx context.Context, s *cdcStream) error {
+	if !time.Now().Before(s.statusAt) {
+		if err := w.sendStatus(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	deadline := s.statusAt
+	if len(s.pending) > 0 && s.flushAt.Before(deadline) {
+		deadline = s.flushAt
+	}
+	receiveCtx, cancel := context.WithDeadline(ctx, deadline)
+	rawMsg, err := s.conn.ReceiveMessage(receiveCtx)
+	cancel()
+	if err != nil {
+		if pgconn.Timeout(err) && ctx.Err() == nil {
+			if len(s.pending) > 0 && !time.Now().Before(s.flushAt) {
+				return w.flushChanges(ctx, s)
+			}
+			return nil
+		}
+		return fmt.Errorf("failed to receive message: %w", err)
+	}
+
+	switch msg := rawMsg.(type) {
+	case *pgproto3.ErrorResponse:
+		return fmt.Errorf("failed to receive message: %w", pgconn.ErrorResponseToPgError(msg))
+	case *pgproto3.CopyData:
+		if len(msg.Data) == 0 {
+			return nil
+		}
+		switch msg.Data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			var pkm pglogrepl.PrimaryKeepaliveMessage
+			if pkm, err = pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:]); err != nil {
+				return fmt.Errorf("failed to parse keepalive message: %w", err)
+			}
+			handleKeepalive(s, pkm)
+		case pglogrepl.XLogDataByteID:
+			var xld pglogrepl.XLogData
+			if xld, err = pglogrepl.ParseXLogData(msg.Data[1:]); err != nil {
+				return fmt.Errorf("failed to parse XLogData: %w", err)
+			}
+			if err = w.handleChange(ctx, s, xld.WALData); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// handleKeepalive handles a primary keepalive message.
+// If no messages are pending, the confirmed position is advanced to the end of the WAL on the server. Transactions
+// that don't touch outbox_messages aren't streamed, so otherwise the position wouldn't move while the outbox is idle
+// and Postgres would keep the WAL of all other changes.
+func handleKeepalive(s *cdcStream, pkm pglogrepl.PrimaryKeepaliveMessage) {
+	if !s.inTx && len(s.pending) == 0 && pkm.ServerWALEnd > s.confirmedLSN {
+		s.confirmedLSN = pkm.ServerWALEnd
+	}
+	if pkm.ReplyRequested {
+		s.statusAt = time.Time{}
+	}
+}
+
+// handleChange handles a logical replication message in the pgoutput format.
+func (w *Worker) handleChange(ctx context.Context, s *cdcStream, walData []byte) error {
+	logicalMsg, err := pglogrepl.Parse(walData)
+	if err != nil {
+		return fmt.Errorf("failed to parse logical replication message: %w", err)
+	}
+
+	switch msg := logicalMsg.(type) {
+	case *pglogrepl.RelationMessage:
+		s.relations[msg.RelationID] = msg
+	case *pglogrepl.BeginMessage:
+		s.inTx = true
+		s.txMessages = nil
+	case *pglogrepl.InsertMessage:
+		rel, ok := s.relations[msg.RelationID]
+		if !ok {
+			return fmt.Errorf("unknown relation ID %d", msg.RelationID)
+		}
+		var m message
+		var status string
+		if m, status, err = decodeInsert(s.typeMap, rel, msg.Tuple); err != nil {
+			return err
+		}
+		if status == outbox.StatusUndelivered {
+			s.txMessages = append(s.txMessages, m)
+		}
+	case *pglogrepl.CommitMessage:
+		s.inTx = false
+		if len(s.pending) == 0 && len(s.txMessages) == 0 {
+			s.confirmedLSN = msg.TransactionEndLSN
+			return nil
+		}
+		if len(s.pending) == 0 {
+			s.flushAt = time.Now().Add(cdcFlushDelay)
+		}
+		s.pending = append(s.pending, s.txMessages...)
+		s.pendingLSN = msg.TransactionEndLSN
+		s.txMessages = nil
+		if len(s.pending) >= w.cfg.batchSize() {
+			return w.flushChanges(ctx, s)
+		}
+	}
+
+	return nil
+}
+
+// errFlushAborted is returned when a flush was aborted because the drain timeout was exceeded.
+var errFlushAborted = errors.New("flush aborted")
+
+// flushChanges sends pending messages to the broker, records the results and confirms their position.
+// The position is confirmed even if ctx is canceled in the meantime, so sent messages aren't read again. If the flush
+// was aborted because the drain timeout was exceeded, the position isn't confirmed and errFlushAborted is returned,
+// because unsent messages are released without an attempt, which polling doesn't retry. The stream then restarts from
+// the last confirmed position and sends them again.
+// Messages that were already sent or attempted, e.g. by backfill or by an aborted flush, are skipped. Expired messages
+// are left undelivered for polling to make them expired.
+func (w *Worker) flushChanges(ctx context.Context, s *cdcStream) error {
+	flushCtx, cancel := w.batchContext(ctx)
+	defer cancel()
+
+	fresh, err := w.freshMessageIDs(flushCtx, s.pending)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	messages := make([]message, 0, len(s.pending))
+	for _, m := range s.pending {
+		if fresh[m.ID] && !m.expired(now) {
+			messages = append(messages, m)
+		}
+	}
+
+	sent := 0
+	if len(messages) > 0 {
+		var aborted bool
+		if sent, aborted, err = w.deliver(flushCtx, w.postgresPool, messages, false); err != nil {
+			return err
+		}
+		if aborted {
+			return fmt.Errorf("%w after sending %d of %d messages", errFlushAborted, sent, len(messages))
+		}
+	}
+
+	w.log.Info("sent messages", "count", sent)
+	s.confirmedLSN = s.pendingLSN
+	s.pending = nil
+
+	statusCtx, cancelStatus := context.WithTimeout(context.WithoutCancel(ctx), w.cfg.timeout())
+	defer cancelStatus()
+	return w.sendStatus(statusCtx, s)
+}
+
+// freshMessageIDs returns the IDs of the messages that are undelivered and weren't attempted yet.
+func (w *Worker) freshMessageIDs(ctx context.Context, messages []message) (map[uuid.UUID]bool, error) {
+	result, err := w.postgresPool.Query(
+		ctx,
+		`SELECT id FROM outbox_messages WHERE id = ANY($1) AND status = $2 AND attempts = 0`,
+		messageIDs(messages),
+		outbox.StatusUndelivered,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox_messages: %w", err)
+	}
+	ids, err := pgx.CollectRows(result, pgx.RowTo[uuid.UUID])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect rows: %w", err)
+	}
+
+	fresh := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		fresh[id] = true
+	}
+	return fresh, nil
+}
+
+// sendStatus reports the confirmed position to Postgres, which lets it discard the WAL before it.
+func (w *Worker) sendStatus(ctx context.Context, s *cdcStream) error {
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, s.conn, pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: s.confirmedLSN,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send standby status update: %w", err)
+	}
+	s.statusAt = time.Now().Add(cdcStatusInterval)
+	return nil
+}
+
+// decodeInsert decodes a row inserted into outbox_messages.
+// It returns the message and its status.
+func decodeInsert(
+	typeMap *pgtype.Map,
+	rel *pglogrepl.RelationMessage,
+	tuple *pglogrepl.TupleData,
+) (message, string, error) {
+	var m message
+	var status string
+	targets := map[string]any{
+		"id":         &m.ID,
+		"seq":        &m.Seq,
+		"created_at": &m.CreatedAt,
+		"status":     &status,
+		"topic":      &m.Topic,
+		"key":        &m.Key,
+		"value":      &m.Value,
+		"headers":    &m.Headers,
+		"attempts":   &m.Attempts,
+		"expires_at": &m.ExpiresAt,
+	}
+
+	if tuple == nil || len(tuple.Columns) != len(rel.Columns) {
+		return message{}, "", errors.New("tuple doesn't match relation")
+	}
+	for i, col := range tuple.Columns {
+		relCol := rel.Columns[i]
+		target, ok := targets[relCol.Name]
+		if !ok || col.DataType != pglogrepl.TupleDataTypeText {
+			continue
+		}
+		if err := typeMap.Scan(relCol.DataType, pgtype.TextFormatCode, col.Data, target); err != nil {
+			return message{}, "", fmt.Errorf("failed to decode column %s: %w", relCol.Name, err)
+		}
+	}
+
+	return m, status, nil
+}
@@ -0,0 +1,248 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/k11v/outbox/internal/publishertest"
+)
+
+func TestDecodeInsert(t *testing.T) {
+	t.Run("Decodes an inserted message into the same outgoing message as polling", func(t *testing.T) {
+		rel := &pglogrepl.RelationMessage{
+			RelationName: "outbox_messages",
+			Columns: []*pglogrepl.RelationMessageColumn{
+				{Name: "id", DataType: pgtype.UUIDOID},
+				{Name: "created_at", DataType: pgtype.TimestamptzOID},
+				{Name: "status", DataType: pgtype.TextOID},
+				{Name: "topic", DataType: pgtype.TextOID},
+				{Name: "key", DataType: pgtype.TextOID},
+				{Name: "value", DataType: pgtype.TextOID},
+				{Name: "headers", DataType: pgtype.JSONBOID},
+				{Name: "claimed_by", DataType: pgtype.TextOID},
+			},
+		}
+		tuple := &pglogrepl.TupleData{
+			Columns: []*pglogrepl.TupleDataColumn{
+				textColumn("5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10"),
+				textColumn("2024-07-10 12:30:45.123456+00"),
+				textColumn(outbox.StatusUndelivered),
+				textColumn("example"),
+				textColumn("a-key"),
+				textColumn("a-value"),
+				textColumn(`[{"key": "Content-Type", "value": "application/json"}]`),
+				{DataType: pglogrepl.TupleDataTypeNull},
+			},
+		}
+
+		got, status, err := decodeInsert(pgtype.NewMap(), rel, tuple)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		want := message{
+			ID:        uuid.MustParse("5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10"),
+			CreatedAt: time.Date(2024, 7, 10, 12, 30, 45, 123456000, time.UTC),
+			Topic:     "example",
+			Key:       "a-key",
+			Value:     "a-value",
+			Headers:   []header{{Key: "Content-Type", Value: "application/json"}},
+		}
+		if status != outbox.StatusUndelivered {
+			t.Errorf("got %q status, want %q", status, outbox.StatusUndelivered)
+		}
+		if !got.CreatedAt.Equal(want.CreatedAt) {
+			t.Errorf("got %v created_at, want %v", got.CreatedAt, want.CreatedAt)
+		}
+		got.CreatedAt = want.CreatedAt
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+
+		wantOutgoing := outbox.Message{
+			ID:      "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+			Topic:   "example",
+			Key:     []byte("a-key"),
+			Value:   []byte("a-value"),
+			Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+		}
+		if gotOutgoing := newOutgoingMessage(got, MetadataConfig{}); !reflect.DeepEqual(gotOutgoing, wantOutgoing) {
+			t.Errorf("got %+v, want %+v", gotOutgoing, wantOutgoing)
+		}
+	})
+
+	t.Run("Returns error when tuple doesn't match relation", func(t *testing.T) {
+		rel := &pglogrepl.RelationMessage{
+			Columns: []*pglogrepl.RelationMessageColumn{{Name: "id", DataType: pgtype.UUIDOID}},
+		}
+		tuple := &pglogrepl.TupleData{}
+
+		if _, _, err := decodeInsert(pgtype.NewMap(), rel, tuple); err == nil {
+			t.Errorf("got nil error, want non-nil")
+		}
+	})
+}
+
+func TestHandleKeepalive(t *testing.T) {
+	t.Run("Advances the confirmed position to the end of the WAL when nothing is pending", func(t *testing.T) {
+		s := &cdcStream{confirmedLSN: 100}
+
+		handleKeepalive(s, pglogrepl.PrimaryKeepaliveMessage{ServerWALEnd: 200})
+
+		if got, want := s.confirmedLSN, pglogrepl.LSN(200); got != want {
+			t.Errorf("got %v confirmed LSN, want %v", got, want)
+		}
+	})
+
+	t.Run("Doesn't advance the confirmed position while messages are pending", func(t *testing.T) {
+		s := &cdcStream{pending: []message{{Topic: "example"}}, pendingLSN: 150, confirmedLSN: 100}
+
+		handleKeepalive(s, pglogrepl.PrimaryKeepaliveMessage{ServerWALEnd: 200})
+
+		if got, want := s.confirmedLSN, pglogrepl.LSN(100); got != want {
+			t.Errorf("got %v confirmed LSN, want %v", got, want)
+		}
+	})
+
+	t.Run("Doesn't advance the confirmed position within a transaction", func(t *testing.T) {
+		s := &cdcStream{inTx: true, confirmedLSN: 100}
+
+		handleKeepalive(s, pglogrepl.PrimaryKeepaliveMessage{ServerWALEnd: 200})
+
+		if got, want := s.confirmedLSN, pglogrepl.LSN(100); got != want {
+			t.Errorf("got %v confirmed LSN, want %v", got, want)
+		}
+	})
+
+	t.Run("Requests a status update when the server asks for a reply", func(t *testing.T) {
+		s := &cdcStream{statusAt: time.Now().Add(time.Hour)}
+
+		handleKeepalive(s, pglogrepl.PrimaryKeepaliveMessage{ReplyRequested: true})
+
+		if !s.statusAt.IsZero() {
+			t.Errorf("got %v status time, want zero", s.statusAt)
+		}
+	})
+}
+
+func TestFlushChanges(t *testing.T) {
+	t.Run("Doesn't confirm the position of a flush aborted by the drain timeout", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, "example", "key", "value")
+		result, err := pool.Query(context.Background(), "SELECT "+messageColumns+" FROM outbox_messages")
+		if err != nil {
+			t.Fatalf("failed to query outbox_messages: %v", err)
+		}
+		messages, err := pgx.CollectRows(result, pgx.RowToStructByName[message])
+		if err != nil {
+			t.Fatalf("failed to collect rows: %v", err)
+		}
+
+		publisher := &publishertest.Publisher{Delay: time.Hour}
+		w := newTestWorker(t, Config{CDC: CDCConfig{Enabled: true}, DrainTimeout: 50 * time.Millisecond}, publisher, pool)
+		s := &cdcStream{pending: messages, pendingLSN: 200, confirmedLSN: 100}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = w.flushChanges(ctx, s)
+
+		if !errors.Is(err, errFlushAborted) {
+			t.Errorf("got %v error, want %v", err, errFlushAborted)
+		}
+		if got, want := s.confirmedLSN, pglogrepl.LSN(100); got != want {
+			t.Errorf("got %v confirmed LSN, want %v", got, want)
+		}
+		var status string
+		var attempts int
+		err = pool.QueryRow(context.Background(), `SELECT status, attempts FROM outbox_messages`).Scan(&status, &attempts)
+		if err != nil {
+			t.Fatalf("failed to query message: %v", err)
+		}
+		if status != outbox.StatusUndelivered || attempts != 0 {
+			t.Errorf("got %q status and %d attempts, want %q and 0", status, attempts, outbox.StatusUndelivered)
+		}
+	})
+}
+
+func TestBackfill(t *testing.T) {
+	t.Run("Sends undelivered messages and then leaves new messages to the stream", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 5)
+
+		publisher := &publishertest.Publisher{}
+		w := newTestWorker(t, Config{BatchSize: 2, CDC: CDCConfig{Enabled: true}}, publisher, pool)
+		if !w.backfill(ctx) {
+			t.Fatalf("got backfill not finished, want finished")
+		}
+
+		if got, want := len(publisher.Messages()), 5; got != want {
+			t.Errorf("got %d sent messages, want %d", got, want)
+		}
+		if got, want := countMessages(t, pool, outbox.StatusDelivered), 5; got != want {
+			t.Errorf("got %d delivered messages, want %d", got, want)
+		}
+
+		insertMessage(t, pool, "example", "key", "value")
+		count, err := w.sendMessages(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+		if count != 0 {
+			t.Errorf("got %d messages sent by polling after backfill, want 0", count)
+		}
+	})
+}
+
+func TestFreshMessageIDs(t *testing.T) {
+	t.Run("Returns undelivered messages that weren't attempted", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 3)
+		_, err := pool.Exec(ctx, `UPDATE outbox_messages SET status = $1 WHERE value = 'value-0'`, outbox.StatusDelivered)
+		if err != nil {
+			t.Fatalf("failed to deliver message: %v", err)
+		}
+		_, err = pool.Exec(ctx, `UPDATE outbox_messages SET attempts = 1 WHERE value = 'value-1'`)
+		if err != nil {
+			t.Fatalf("failed to attempt message: %v", err)
+		}
+		result, err := pool.Query(ctx, "SELECT "+messageColumns+" FROM outbox_messages")
+		if err != nil {
+			t.Fatalf("failed to query outbox_messages: %v", err)
+		}
+		messages, err := pgx.CollectRows(result, pgx.RowToStructByName[message])
+		if err != nil {
+			t.Fatalf("failed to collect rows: %v", err)
+		}
+
+		w := newTestWorker(t, Config{CDC: CDCConfig{Enabled: true}}, &publishertest.Publisher{}, pool)
+		fresh, err := w.freshMessageIDs(ctx, messages)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		for _, m := range messages {
+			if got, want := fresh[m.ID], m.Value == "value-2"; got != want {
+				t.Errorf("got fresh %v for %s, want %v", got, m.Value, want)
+			}
+		}
+	})
+}
+
+func textColumn(s string) *pglogrepl.TupleDataColumn {
+	return &pglogrepl.TupleDataColumn{
+		DataType: pglogrepl.TupleDataTypeText,
+		Length:   uint32(len(s)),
+		Data:     []byte(s),
+	}
+}
@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// sequenceLockKey is the key of the advisory lock that serializes the assignment of commit sequence numbers.
+const sequenceLockKey = 0x6f757473657173 // "outseqs" in ASCII
+
+// cursorName is the name of the commit order cursor in outbox_cursors.
+const cursorName = "commit_order"
+
+// sequenceMessages assigns commit sequence numbers to the undelivered messages that don't have one yet.
+// A run only sees messages of transactions that committed before it started, and runs are serialized with an advisory
+// lock, so a message is numbered after every message of a transaction that committed before its own. Messages of
+// transactions that committed between two runs are numbered in transaction ID order. A transaction that starts after
+// another one committed gets a larger transaction ID, so its messages are numbered after the other's in any case.
+// A transaction still in progress doesn't hold back messages of other transactions, its messages are numbered once it
+// commits. The run is skipped while another worker assigns numbers, and the messages it misses are numbered by the
+// next run.
+func (w *Worker) sequenceMessages(ctx context.Context) error {
+	tx, err := w.postgresPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func(tx pgx.Tx) {
+		_ = tx.Rollback(ctx)
+	}(tx)
+
+	var acquired bool
+	err = tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1)`, int64(sequenceLockKey)).Scan(&acquired)
+	if err != nil {
+		return fmt.Errorf("failed to query pg_try_advisory_xact_lock: %w", err)
+	}
+	if !acquired {
+		return nil
+	}
+
+	// The ordered subquery isn't flattened into the outer query, so nextval is called in that order.
+
+	tag, err := tx.Exec(
+		ctx,
+		`
+			WITH numbered AS (
+				SELECT id, nextval('outbox_messages_commit_seq') AS commit_seq
+				FROM (
+					SELECT id
+					FROM outbox_messages
+					WHERE commit_seq IS NULL AND status IN (@undelivered, @claimed)
+					ORDER BY xid, seq
+				) committed
+			)
+			UPDATE outbox_messages
+			SET commit_seq = numbered.commit_seq
+			FROM numbered
+			WHERE outbox_messages.id = numbered.id
+		`,
+		pgx.NamedArgs{
+			"undelivered": outbox.StatusUndelivered,
+			"claimed":     outbox.StatusClaimed,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update commit_seq of outbox_messages: %w", err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	if count := tag.RowsAffected(); count > 0 {
+		w.log.Debug("sequenced messages", "count", count)
+	}
+	return nil
+}
+
+// advanceCursor moves the commit order cursor in outbox_cursors past the messages that are delivered, dead or expired,
+// and keeps its position for the next claims. Every message up to the position is settled, so only messages after it
+// are candidates and claims don't scan the settled ones. The cursor never moves back, and messages are numbered in
+// increasing order and never become unsettled again, so a cursor advanced by another worker from an older snapshot is
+// still valid.
+func (w *Worker) advanceCursor(ctx context.Context) error {
+	err := w.postgresPool.QueryRow(
+		ctx,
+		`
+			WITH previous AS (
+				SELECT coalesce((SELECT position FROM outbox_cursors WHERE name = @name), 0) AS position
+			)
+			INSERT INTO outbox_cursors (name, position)
+			SELECT @name, coalesce(
+				(
+					SELECT min(commit_seq) - 1
+					FROM outbox_messages
+					WHERE commit_seq > previous.position AND status IN (@undelivered, @claimed)
+				),
+				(SELECT max(commit_seq) FROM outbox_messages WHERE commit_seq > previous.position),
+				previous.position
+			)
+			FROM previous
+			ON CONFLICT (name) DO UPDATE
+			SET position = greatest(outbox_cursors.position, excluded.position), updated_at = now()
+			RETURNING position
+		`,
+		pgx.NamedArgs{
+			"name":        cursorName,
+			"undelivered": outbox.StatusUndelivered,
+			"claimed":     outbox.StatusClaimed,
+		},
+	).Scan(&w.cursor)
+	if err != nil {
+		return fmt.Errorf("failed to update outbox_cursors: %w", err)
+	}
+	return nil
+}
@@ -1,15 +1,137 @@
 package worker
 
 import (
+	"fmt"
+	"regexp"
 	"time"
 )
 
+const (
+	// ClaimModeLock claims messages with row locks held in a transaction while messages are sent.
+	ClaimModeLock = "lock"
+	// ClaimModeLease claims messages with a lease and sends them outside of any transaction.
+	ClaimModeLease = "lease"
+)
+
+const (
+	// OrderingNone sends messages without regard to the order of messages with the same key.
+	OrderingNone = "none"
+	// OrderingKey never sends a message while an older message with the same topic and key isn't delivered.
+	OrderingKey = "key"
+)
+
 // Config holds the worker configuration.
 // The zero value is a valid configuration.
 type Config struct {
-	BatchSize int           `env:"BATCH_SIZE"` // default: 100
-	Interval  time.Duration `env:"INTERVAL"`   // default: 1s
-	Timeout   time.Duration `env:"TIMEOUT"`    // default: 10s
+	BatchBytes     int                  `env:"BATCH_BYTES"` // default: 0, unlimited
+	BatchSize      int                  `env:"BATCH_SIZE"`  // default: 100
+	CDC            CDCConfig            `envPrefix:"CDC_"`
+	ClaimMode      string               `env:"CLAIM_MODE"` // default: "lock"
+	CommitOrder    bool                 `env:"COMMIT_ORDER"`
+	Cursor         bool                 `env:"CURSOR"` // persist the commit order high-water mark in outbox_cursors
+	DeadLetter     DeadLetterConfig     `envPrefix:"DEAD_LETTER_"`
+	DrainTimeout   time.Duration        `env:"DRAIN_TIMEOUT"`  // default: 5s
+	ID             string               `env:"ID"`             // default: hostname with a random suffix
+	Interval       time.Duration        `env:"INTERVAL"`       // default: 1s
+	LeaseDuration  time.Duration        `env:"LEASE_DURATION"` // default: 30s
+	LeaderElection LeaderElectionConfig `envPrefix:"LEADER_ELECTION_"`
+	Listen         bool                 `env:"LISTEN"`
+	Metadata       MetadataConfig       `envPrefix:"METADATA_"`
+	Ordering       string               `env:"ORDERING"` // default: "none"
+	Priority       PriorityConfig       `envPrefix:"PRIORITY_"`
+	Retry          RetryConfig          `envPrefix:"RETRY_"`
+	Timeout        time.Duration        `env:"TIMEOUT"` // default: 10s
+}
+
+// LeaderElectionConfig holds the leader election configuration.
+// The zero value is a valid configuration.
+type LeaderElectionConfig struct {
+	Enabled bool  `env:"ENABLED"`
+	LockKey int64 `env:"LOCK_KEY"` // default: 0x6f7574626f78 ("outbox" in ASCII)
+}
+
+// CDCConfig holds the change data capture configuration.
+// The zero value is a valid configuration.
+type CDCConfig struct {
+	Enabled     bool   `env:"ENABLED"`
+	Publication string `env:"PUBLICATION"` // default: "outbox"
+	Slot        string `env:"SLOT"`        // default: "outbox"
+}
+
+// RetryConfig holds the configuration of retries of messages that failed to be sent.
+// The zero value is a valid configuration.
+type RetryConfig struct {
+	InitialBackoff time.Duration `env:"INITIAL_BACKOFF"` // default: 1s
+	MaxBackoff     time.Duration `env:"MAX_BACKOFF"`     // default: 5m
+	Jitter         float64       `env:"JITTER"`          // default: 0.2, fraction of the backoff, negative means none
+	MaxAttempts    int           `env:"MAX_ATTEMPTS"`    // default: 10, then the message is dead
+}
+
+// DeadLetterConfig holds the configuration of dead letter topics.
+// The zero value is a valid configuration.
+type DeadLetterConfig struct {
+	Enabled     bool   `env:"ENABLED"`
+	TopicSuffix string `env:"TOPIC_SUFFIX"` // default: ".dlt"
+}
+
+// MetadataConfig holds the configuration of the outbox metadata that is added to published messages.
+// The zero value is a valid configuration.
+type MetadataConfig struct {
+	Enabled         bool   `env:"ENABLED"`           // add the headers and set the time of messages to created_at
+	AttemptHeader   string `env:"ATTEMPT_HEADER"`    // default: "outbox-attempt"
+	CreatedAtHeader string `env:"CREATED_AT_HEADER"` // default: "outbox-created-at"
+	IDHeader        string `env:"ID_HEADER"`         // default: "outbox-id"
+	Service         string `env:"SERVICE"`           // default: "", the service header is omitted
+	ServiceHeader   string `env:"SERVICE_HEADER"`    // default: "outbox-service"
+}
+
+// PriorityConfig holds the configuration of message priorities.
+// The zero value is a valid configuration.
+type PriorityConfig struct {
+	Enabled bool          `env:"ENABLED"`
+	Aging   time.Duration `env:"AGING"` // default: 1m, how long a message waits to have its priority raised by one
+}
+
+// slotNameRegexp matches valid replication slot names.
+var slotNameRegexp = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func (c Config) validate() error {
+	switch c.claimMode() {
+	case ClaimModeLock, ClaimModeLease:
+	default:
+		return fmt.Errorf("unknown claim mode %q", c.ClaimMode)
+	}
+	switch c.ordering() {
+	case OrderingNone:
+	case OrderingKey:
+		if c.CDC.Enabled {
+			return fmt.Errorf("ordering %q isn't supported in change data capture mode", c.Ordering)
+		}
+	default:
+		return fmt.Errorf("unknown ordering %q", c.Ordering)
+	}
+	if !slotNameRegexp.MatchString(c.CDC.slot()) {
+		return fmt.Errorf("invalid replication slot name %q", c.CDC.Slot)
+	}
+	if c.CommitOrder && c.CDC.Enabled {
+		return fmt.Errorf("commit order isn't supported in change data capture mode, which sends messages in commit order")
+	}
+	if c.Cursor && !c.CommitOrder {
+		return fmt.Errorf("the cursor requires commit order")
+	}
+	if c.Priority.Enabled && c.CDC.Enabled {
+		return fmt.Errorf("priorities aren't supported in change data capture mode")
+	}
+	if c.Priority.Aging < 0 {
+		return fmt.Errorf("priority aging %v is negative", c.Priority.Aging)
+	}
+	if c.BatchBytes < 0 {
+		return fmt.Errorf("batch bytes %d is negative", c.BatchBytes)
+	}
+	if c.Retry.Jitter > 1 {
+		return fmt.Errorf("retry jitter %v is greater than 1", c.Retry.Jitter)
+	}
+	return nil
 }
 
 func (c Config) batchSize() int {
@@ -20,6 +142,22 @@ func (c Config) batchSize() int {
 	return s
 }
 
+func (c Config) claimMode() string {
+	m := c.ClaimMode
+	if m == "" {
+		m = ClaimModeLock
+	}
+	return m
+}
+
+func (c Config) drainTimeout() time.Duration {
+	t := c.DrainTimeout
+	if t == 0 {
+		t = 5 * time.Second
+	}
+	return t
+}
+
 func (c Config) interval() time.Duration {
 	i := c.Interval
 	if i == 0 {
@@ -28,6 +166,22 @@ func (c Config) interval() time.Duration {
 	return i
 }
 
+func (c Config) leaseDuration() time.Duration {
+	d := c.LeaseDuration
+	if d == 0 {
+		d = 30 * time.Second
+	}
+	return d
+}
+
+func (c Config) ordering() string {
+	o := c.Ordering
+	if o == "" {
+		o = OrderingNone
+	}
+	return o
+}
+
 func (c Config) timeout() time.Duration {
 	t := c.Timeout
 	if t == 0 {
@@ -35,3 +189,110 @@ func (c Config) timeout() time.Duration {
 	}
 	return t
 }
+
+func (c LeaderElectionConfig) lockKey() int64 {
+	k := c.LockKey
+	if k == 0 {
+		k = 0x6f7574626f78
+	}
+	return k
+}
+
+func (c CDCConfig) publication() string {
+	p := c.Publication
+	if p == "" {
+		p = "outbox"
+	}
+	return p
+}
+
+func (c CDCConfig) slot() string {
+	s := c.Slot
+	if s == "" {
+		s = "outbox"
+	}
+	return s
+}
+
+func (c RetryConfig) initialBackoff() time.Duration {
+	b := c.InitialBackoff
+	if b == 0 {
+		b = time.Second
+	}
+	return b
+}
+
+func (c RetryConfig) maxBackoff() time.Duration {
+	b := c.MaxBackoff
+	if b == 0 {
+		b = 5 * time.Minute
+	}
+	return b
+}
+
+func (c RetryConfig) maxAttempts() int {
+	a := c.MaxAttempts
+	if a == 0 {
+		a = 10
+	}
+	return a
+}
+
+func (c RetryConfig) jitter() float64 {
+	j := c.Jitter
+	if j == 0 {
+		j = 0.2
+	}
+	if j < 0 {
+		j = 0
+	}
+	return j
+}
+
+func (c MetadataConfig) attemptHeader() string {
+	h := c.AttemptHeader
+	if h == "" {
+		h = "outbox-attempt"
+	}
+	return h
+}
+
+func (c MetadataConfig) createdAtHeader() string {
+	h := c.CreatedAtHeader
+	if h == "" {
+		h = "outbox-created-at"
+	}
+	return h
+}
+
+func (c MetadataConfig) idHeader() string {
+	h := c.IDHeader
+	if h == "" {
+		h = "outbox-id"
+	}
+	return h
+}
+
+func (c MetadataConfig) serviceHeader() string {
+	h := c.ServiceHeader
+	if h == "" {
+		h = "outbox-service"
+	}
+	return h
+}
+
+func (c PriorityConfig) aging() time.Duration {
+	a := c.Aging
+	if a == 0 {
+		a = time.Minute
+	}
+	return a
+}
+
+func (c DeadLetterConfig) topicSuffix() string {
+	s := c.TopicSuffix
+	if s == "" {
+		s = ".dlt"
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+package worker
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// Headers added to messages sent to dead letter topics.
+const (
+	deadLetterTopicHeader    = "outbox-original-topic"
+	deadLetterErrorHeader    = "outbox-error"
+	deadLetterAttemptsHeader = "outbox-attempts"
+)
+
+// sendDeadLetters finds failed messages that ran out of attempts and, if dead letter topics are enabled, sends them
+// to their dead letter topics.
+// It reports for each message whether it is dead. A message that fails to be sent to its dead letter topic isn't
+// dead and is retried as usual.
+func (w *Worker) sendDeadLetters(ctx context.Context, messages []message, errs []error) []bool {
+	dead := make([]bool, len(messages))
+
+	var indexes []int
+	var deadLetters []outbox.Message
+	for i, m := range messages {
+		if errs[i] == nil || m.Attempts+1 < w.cfg.Retry.maxAttempts() {
+			continue
+		}
+		if !w.cfg.DeadLetter.Enabled {
+			dead[i] = true
+			continue
+		}
+		indexes = append(indexes, i)
+		deadLetters = append(deadLetters, w.newDeadLetter(m, errs[i]))
+	}
+	if len(deadLetters) == 0 {
+		return dead
+	}
+
+	for j, err := range w.publisher.Publish(ctx, deadLetters) {
+		i := indexes[j]
+		if err != nil {
+			w.log.Error(
+				"failed to send message to dead letter topic",
+				"id", messages[i].ID,
+				"topic", deadLetters[j].Topic,
+				"error", err,
+			)
+			continue
+		}
+		dead[i] = true
+	}
+	return dead
+}
+
+// newDeadLetter returns the message that is sent to the dead letter topic of m.
+// It carries the original topic, the error and the number of attempts in headers. Its ID is the ID of m followed by
+// the topic suffix, so brokers that deduplicate messages don't drop it as a copy of m.
+func (w *Worker) newDeadLetter(m message, err error) outbox.Message {
+	deadLetter := newOutgoingMessage(m, w.cfg.Metadata)
+	deadLetter.ID = m.ID.String() + w.cfg.DeadLetter.topicSuffix()
+	deadLetter.Topic = m.Topic + w.cfg.DeadLetter.topicSuffix()
+	deadLetter.Headers = append(
+		deadLetter.Headers,
+		outbox.Header{Key: deadLetterTopicHeader, Value: []byte(m.Topic)},
+		outbox.Header{Key: deadLetterErrorHeader, Value: []byte(err.Error())},
+		outbox.Header{Key: deadLetterAttemptsHeader, Value: []byte(strconv.Itoa(m.Attempts + 1))},
+	)
+	return deadLetter
+}
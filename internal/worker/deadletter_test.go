@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/k11v/outbox/internal/publishertest"
+)
+
+func TestSendDeadLetters(t *testing.T) {
+	t.Run("Marks messages that ran out of attempts as dead", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, "missing", "key", "value")
+
+		publisher := &publishertest.Publisher{Fail: failTopic("missing")}
+		cfg := Config{Retry: RetryConfig{InitialBackoff: 1, MaxBackoff: 1, MaxAttempts: 2}}
+		w := newTestWorker(t, cfg, publisher, pool)
+
+		for i := 0; i < 2; i++ {
+			if _, err := w.sendMessages(ctx); err != nil {
+				t.Fatalf("got %v error, want nil", err)
+			}
+		}
+
+		if got, want := countMessages(t, pool, outbox.StatusDead), 1; got != want {
+			t.Errorf("got %d dead messages, want %d", got, want)
+		}
+		publishes := publisher.PublishCount()
+		if _, err := w.sendMessages(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+		if got, want := publisher.PublishCount(), publishes; got != want {
+			t.Errorf("got %d publishes, want %d", got, want)
+		}
+	})
+
+	t.Run("Sends dead messages to dead letter topics", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, "example", "bad", "value")
+
+		publisher := &publishertest.Publisher{Fail: func(m outbox.Message) error {
+			if m.Topic == "example" {
+				return errNotEnoughReplicas
+			}
+			return nil
+		}}
+		cfg := Config{Retry: RetryConfig{MaxAttempts: 1}, DeadLetter: DeadLetterConfig{Enabled: true}}
+		w := newTestWorker(t, cfg, publisher, pool)
+
+		if _, err := w.sendMessages(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := countMessages(t, pool, outbox.StatusDead), 1; got != want {
+			t.Errorf("got %d dead messages, want %d", got, want)
+		}
+		msgs := publisher.Messages()
+		if got, want := len(msgs), 1; got != want {
+			t.Fatalf("got %d published messages, want %d", got, want)
+		}
+		if got, want := msgs[0].Topic, "example.dlt"; got != want {
+			t.Errorf("got %q topic, want %q", got, want)
+		}
+		headers := make(map[string]string)
+		for _, h := range msgs[0].Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		wantHeaders := map[string]string{
+			deadLetterTopicHeader:    "example",
+			deadLetterErrorHeader:    errNotEnoughReplicas.Error(),
+			deadLetterAttemptsHeader: "1",
+		}
+		for key, want := range wantHeaders {
+			if got := headers[key]; got != want {
+				t.Errorf("got %q %s header, want %q", got, key, want)
+			}
+		}
+	})
+
+	t.Run("Retries messages that fail to be sent to dead letter topics", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessage(t, pool, "example", "key", "value")
+
+		publisher := &publishertest.Publisher{Err: errors.New("broker is unavailable")}
+		cfg := Config{Retry: RetryConfig{MaxAttempts: 1}, DeadLetter: DeadLetterConfig{Enabled: true}}
+		w := newTestWorker(t, cfg, publisher, pool)
+
+		if _, err := w.sendMessages(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := countMessages(t, pool, outbox.StatusDead), 0; got != want {
+			t.Errorf("got %d dead messages, want %d", got, want)
+		}
+		if got, want := countMessages(t, pool, outbox.StatusUndelivered), 1; got != want {
+			t.Errorf("got %d undelivered messages, want %d", got, want)
+		}
+	})
+}
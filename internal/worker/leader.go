@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	roleLeader  = "leader"
+	roleStandby = "standby"
+)
+
+// runElected runs the worker with leader election.
+// Workers compete for a session-level advisory lock on a dedicated connection. The worker that holds the lock is the
+// leader and sends messages, the others are standbys and try to take the lock every interval. Postgres releases the
+// lock when the leader's session ends, so a standby takes over when the leader dies or loses its connection.
+func (w *Worker) runElected(ctx context.Context) {
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			w.closeConn(conn)
+		}
+	}()
+
+	w.log.Info("running as standby", "role", roleStandby)
+	w.loop(ctx, func() bool {
+		if conn == nil {
+			var err error
+			if conn, err = w.acquireConn(); err != nil {
+				w.log.Error("failed to acquire connection for leader election", "error", err)
+				return true
+			}
+		}
+
+		acquired, err := w.tryLock(conn)
+		if err != nil {
+			w.log.Error("failed to try advisory lock", "error", err)
+			w.closeConn(conn)
+			conn = nil
+			return true
+		}
+		if !acquired {
+			w.log.Debug("remained standby", "role", roleStandby)
+			return true
+		}
+
+		w.log.Info("became leader", "role", roleLeader)
+		if w.loop(ctx, func() bool { return w.lead(ctx, conn) }) {
+			return false
+		}
+
+		w.log.Warn("lost leadership", "role", roleStandby)
+		w.closeConn(conn)
+		conn = nil
+		return true
+	})
+}
+
+// lead checks that the worker still holds the advisory lock and sends a batch of messages.
+// It reports whether the worker is still the leader.
+func (w *Worker) lead(ctx context.Context, conn *pgx.Conn) bool {
+	pingCtx, cancel := context.WithTimeout(ctx, w.cfg.timeout())
+	defer cancel()
+
+	if err := conn.Ping(pingCtx); err != nil {
+		if ctx.Err() != nil {
+			return true
+		}
+		w.log.Error("failed to ping leader election connection", "error", err)
+		return false
+	}
+
+	w.sendBatch(ctx)
+	return true
+}
+
+// tryLock tries to take the advisory lock without waiting.
+func (w *Worker) tryLock(conn *pgx.Conn) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.timeout())
+	defer cancel()
+
+	var acquired bool
+	err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, w.cfg.LeaderElection.lockKey()).Scan(&acquired)
+	if err != nil {
+		return false, fmt.Errorf("failed to query pg_try_advisory_lock: %w", err)
+	}
+	return acquired, nil
+}
@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"context"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/k11v/outbox/internal/publishertest"
+)
+
+func TestLeaderElection(t *testing.T) {
+	t.Run("Allows one leader and lets a standby take over", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		cfg := Config{LeaderElection: LeaderElectionConfig{Enabled: true, LockKey: rand.Int64()}}
+		leader := newTestWorker(t, cfg, &publishertest.Publisher{}, pool)
+		standby := newTestWorker(t, cfg, &publishertest.Publisher{}, pool)
+
+		leaderConn, err := leader.acquireConn()
+		if err != nil {
+			t.Fatalf("failed to acquire connection: %v", err)
+		}
+		standbyConn, err := standby.acquireConn()
+		if err != nil {
+			t.Fatalf("failed to acquire connection: %v", err)
+		}
+		defer standby.closeConn(standbyConn)
+
+		if acquired, err := leader.tryLock(leaderConn); err != nil || !acquired {
+			t.Fatalf("got %v, %v, want true, nil", acquired, err)
+		}
+		if acquired, err := standby.tryLock(standbyConn); err != nil || acquired {
+			t.Fatalf("got %v, %v, want false, nil", acquired, err)
+		}
+
+		leader.closeConn(leaderConn)
+
+		// Postgres releases the lock shortly after the session ends.
+		tookOver := waitFor(func() bool {
+			acquired, err := standby.tryLock(standbyConn)
+			return err == nil && acquired
+		})
+		if !tookOver {
+			t.Errorf("got standby unable to take the lock, want taken")
+		}
+	})
+
+	t.Run("Sends messages as leader", func(t *testing.T) {
+		const messageCount = 10
+
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, messageCount)
+
+		cfg := Config{
+			Interval:       10 * time.Millisecond,
+			LeaderElection: LeaderElectionConfig{Enabled: true, LockKey: rand.Int64()},
+		}
+		publisher := &publishertest.Publisher{}
+		w := newTestWorker(t, cfg, publisher, pool)
+
+		stop := runWorker(w)
+		waitFor(func() bool {
+			return countMessages(t, pool, outbox.StatusDelivered) == messageCount
+		})
+		stop()
+
+		if got, want := len(publisher.Messages()), messageCount; got != want {
+			t.Errorf("got %d sent messages, want %d", got, want)
+		}
+
+		// Postgres releases the lock shortly after the session ends.
+		released := waitFor(func() bool {
+			var locked bool
+			err := pool.QueryRow(
+				context.Background(),
+				`
+					SELECT EXISTS (
+						SELECT 1
+						FROM pg_locks
+						WHERE locktype = 'advisory'
+							AND classid::bigint = $1::bigint >> 32
+							AND objid::bigint = $1::bigint & 4294967295
+					)
+				`,
+				cfg.LeaderElection.LockKey,
+			).Scan(&locked)
+			return err == nil && !locked
+		})
+		if !released {
+			t.Errorf("got advisory lock held after stop, want released")
+		}
+	})
+}
+
+// waitFor calls cond until it returns true or 5 seconds pass.
+// It reports whether cond returned true.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
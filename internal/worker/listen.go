@@ -0,0 +1,63 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// listenRetryDelay is the delay before reconnecting after the listening connection fails.
+const listenRetryDelay = time.Second
+
+// listen listens for notifications about new outbox messages on a dedicated connection and wakes the worker up.
+// It reconnects when the connection is lost and wakes the worker up after reconnecting because notifications sent
+// while it was disconnected are lost. It stops when ctx is canceled.
+func (w *Worker) listen(ctx context.Context) {
+	for {
+		err := w.listenConn(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		w.log.Error("failed to listen for notifications", "error", err)
+
+		select {
+		case <-time.After(listenRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listenConn listens for notifications until the connection fails or ctx is canceled.
+func (w *Worker) listenConn(ctx context.Context) error {
+	conn, err := w.acquireConn()
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer w.closeConn(conn)
+
+	if _, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{outbox.Channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	w.log.Debug("listening for notifications", "channel", outbox.Channel)
+	w.wakeUp()
+
+	for {
+		if _, err = conn.WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		w.wakeUp()
+	}
+}
+
+// wakeUp makes the worker send the next batch without waiting for the interval.
+// Wake-ups that arrive while the worker is busy are coalesced into one.
+func (w *Worker) wakeUp() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/k11v/outbox/internal/publishertest"
+)
+
+func TestListen(t *testing.T) {
+	t.Run("Wakes up on notification", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		w := newTestWorker(t, Config{Interval: time.Hour, Listen: true}, &publishertest.Publisher{}, pool)
+		stop := runWorker(w)
+		defer stop()
+
+		waitForListener(t, pool, 0)
+		insertMessages(t, pool, 1)
+		notify(t, pool)
+
+		if !waitFor(func() bool { return countMessages(t, pool, outbox.StatusDelivered) == 1 }) {
+			t.Errorf("got message undelivered, want delivered")
+		}
+	})
+
+	t.Run("Wakes up on notification after reconnecting", func(t *testing.T) {
+		pool := postgrestest.NewPool(t)
+		w := newTestWorker(t, Config{Interval: time.Hour, Listen: true}, &publishertest.Publisher{}, pool)
+		stop := runWorker(w)
+		defer stop()
+
+		pid := waitForListener(t, pool, 0)
+		if _, err := pool.Exec(context.Background(), `SELECT pg_terminate_backend($1)`, pid); err != nil {
+			t.Fatalf("failed to terminate listener: %v", err)
+		}
+		waitForListener(t, pool, pid)
+		insertMessages(t, pool, 1)
+		notify(t, pool)
+
+		if !waitFor(func() bool { return countMessages(t, pool, outbox.StatusDelivered) == 1 }) {
+			t.Errorf("got message undelivered, want delivered")
+		}
+	})
+}
+
+// runWorker runs the worker in the background.
+// It returns a function that stops the worker and waits for it to return.
+func runWorker(w *Worker) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// waitForListener waits for a backend other than oldPID to listen on outbox.Channel and returns its PID.
+func waitForListener(t *testing.T, pool *pgxpool.Pool, oldPID int32) int32 {
+	t.Helper()
+
+	var pid int32
+	found := waitFor(func() bool {
+		err := pool.QueryRow(
+			context.Background(),
+			`
+				SELECT pid
+				FROM pg_stat_activity
+				WHERE query = 'LISTEN "' || $1 || '"' AND state = 'idle' AND pid <> $2
+				ORDER BY backend_start DESC
+				LIMIT 1
+			`,
+			outbox.Channel,
+			oldPID,
+		).Scan(&pid)
+		return err == nil
+	})
+	if !found {
+		t.Fatalf("got no listener, want one")
+	}
+	return pid
+}
+
+func notify(t *testing.T, pool *pgxpool.Pool) {
+	t.Helper()
+
+	if _, err := pool.Exec(context.Background(), `SELECT pg_notify($1, '')`, outbox.Channel); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// message is a row of outbox_messages that is published.
+type message struct {
+	ID        uuid.UUID  `db:"id"`
+	Seq       int64      `db:"seq"` // increases in the order messages are inserted
+	CreatedAt time.Time  `db:"created_at"`
+	Topic     string     `db:"topic"`
+	Key       string     `db:"key"`
+	Value     string     `db:"value"`
+	Headers   []header   `db:"headers"`
+	Attempts  int        `db:"attempts"`   // number of previous attempts to send the message
+	ExpiresAt *time.Time `db:"expires_at"` // optional, the message must not be sent after it
+}
+
+// expired reports whether the message must not be sent at now.
+func (m message) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+type header struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// newOutgoingMessages maps rows of outbox_messages to messages that are published.
+func newOutgoingMessages(messages []message, metadata MetadataConfig) []outbox.Message {
+	outgoing := make([]outbox.Message, len(messages))
+	for i, m := range messages {
+		outgoing[i] = newOutgoingMessage(m, metadata)
+	}
+	return outgoing
+}
+
+// newOutgoingMessage maps a row of outbox_messages to a message that is published.
+// If metadata is enabled, the published message also carries the ID, the creation time and the attempt number of the
+// outbox message and the service name in headers, and its time is the creation time, so consumers can deduplicate
+// messages and see when the events happened.
+func newOutgoingMessage(m message, metadata MetadataConfig) outbox.Message {
+	headers := make([]outbox.Header, len(m.Headers))
+	for i, h := range m.Headers {
+		headers[i] = outbox.Header{
+			Key:   h.Key,
+			Value: []byte(h.Value),
+		}
+	}
+	outgoing := outbox.Message{
+		ID:      m.ID.String(),
+		Topic:   m.Topic,
+		Key:     []byte(m.Key),
+		Value:   []byte(m.Value),
+		Headers: headers,
+	}
+
+	if metadata.Enabled {
+		outgoing.Time = m.CreatedAt
+		outgoing.Headers = append(
+			outgoing.Headers,
+			outbox.Header{Key: metadata.idHeader(), Value: []byte(m.ID.String())},
+			outbox.Header{Key: metadata.createdAtHeader(), Value: []byte(m.CreatedAt.UTC().Format(time.RFC3339Nano))},
+			outbox.Header{Key: metadata.attemptHeader(), Value: []byte(strconv.Itoa(m.Attempts + 1))},
+		)
+		if metadata.Service != "" {
+			outgoing.Headers = append(
+				outgoing.Headers,
+				outbox.Header{Key: metadata.serviceHeader(), Value: []byte(metadata.Service)},
+			)
+		}
+	}
+
+	return outgoing
+}
+
+// messageIDs returns the IDs of messages.
+func messageIDs(messages []message) []uuid.UUID {
+	ids := make([]uuid.UUID, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return ids
+}
@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+func TestNewOutgoingMessage(t *testing.T) {
+	m := message{
+		ID:        uuid.MustParse("5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10"),
+		CreatedAt: time.Date(2024, 7, 10, 12, 30, 45, 123456000, time.FixedZone("", 3*60*60)),
+		Topic:     "example",
+		Key:       "a-key",
+		Value:     "a-value",
+		Headers:   []header{{Key: "Content-Type", Value: "application/json"}},
+		Attempts:  2,
+	}
+
+	t.Run("Adds no metadata when metadata is disabled", func(t *testing.T) {
+		got := newOutgoingMessage(m, MetadataConfig{})
+
+		want := outbox.Message{
+			ID:      "5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10",
+			Topic:   "example",
+			Key:     []byte("a-key"),
+			Value:   []byte("a-value"),
+			Headers: []outbox.Header{{Key: "Content-Type", Value: []byte("application/json")}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("Adds metadata headers and sets the time to created_at", func(t *testing.T) {
+		got := newOutgoingMessage(m, MetadataConfig{Enabled: true, Service: "payments"})
+
+		wantHeaders := []outbox.Header{
+			{Key: "Content-Type", Value: []byte("application/json")},
+			{Key: "outbox-id", Value: []byte("5b0b3f8e-8d1c-4b8e-9a57-3c1f7d2f4a10")},
+			{Key: "outbox-created-at", Value: []byte("2024-07-10T09:30:45.123456Z")},
+			{Key: "outbox-attempt", Value: []byte("3")},
+			{Key: "outbox-service", Value: []byte("payments")},
+		}
+		if !reflect.DeepEqual(got.Headers, wantHeaders) {
+			t.Errorf("got %+v headers, want %+v", got.Headers, wantHeaders)
+		}
+		if got, want := got.Time, m.CreatedAt; !got.Equal(want) {
+			t.Errorf("got %v time, want %v", got, want)
+		}
+	})
+
+	t.Run("Uses configured header names and omits the service header without a service", func(t *testing.T) {
+		cfg := MetadataConfig{
+			Enabled:         true,
+			AttemptHeader:   "x-attempt",
+			CreatedAtHeader: "x-created-at",
+			IDHeader:        "x-id",
+			ServiceHeader:   "x-service",
+		}
+		got := newOutgoingMessage(m, cfg)
+
+		var gotKeys []string
+		for _, h := range got.Headers {
+			gotKeys = append(gotKeys, h.Key)
+		}
+		if want := []string{"Content-Type", "x-id", "x-created-at", "x-attempt"}; !reflect.DeepEqual(gotKeys, want) {
+			t.Errorf("got %v header keys, want %v", gotKeys, want)
+		}
+	})
+}
@@ -0,0 +1,332 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/k11v/outbox/internal/publishertest"
+)
+
+func TestSendMessagesOrdering(t *testing.T) {
+	for _, claimMode := range []string{ClaimModeLock, ClaimModeLease} {
+		t.Run("Holds back messages with the key of a failed message in "+claimMode+" mode", func(t *testing.T) {
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+			insertMessage(t, pool, "example", "a", "a-0")
+			insertMessage(t, pool, "example", "b", "b-0")
+			insertMessage(t, pool, "example", "a", "a-1")
+			insertMessage(t, pool, "example", "b", "b-1")
+
+			failing := true
+			publisher := &publishertest.Publisher{Fail: func(m outbox.Message) error {
+				if failing && string(m.Value) == "a-0" {
+					return errNotEnoughReplicas
+				}
+				return nil
+			}}
+			cfg := Config{ClaimMode: claimMode, Ordering: OrderingKey, Retry: RetryConfig{InitialBackoff: 1, MaxBackoff: 1}}
+			w := newTestWorker(t, cfg, publisher, pool)
+
+			for i := 0; i < 3; i++ {
+				if _, err := w.sendMessages(ctx); err != nil {
+					t.Fatalf("got %v error, want nil", err)
+				}
+			}
+			if got, want := sentValues(publisher), []string{"b-0", "b-1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v sent, want %v", got, want)
+			}
+
+			failing = false
+			for i := 0; i < 3; i++ {
+				if _, err := w.sendMessages(ctx); err != nil {
+					t.Fatalf("got %v error, want nil", err)
+				}
+			}
+			if got, want := sentValues(publisher), []string{"b-0", "b-1", "a-0", "a-1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v sent, want %v", got, want)
+			}
+		})
+
+		t.Run("Keeps the order of each key with concurrent workers and failures in "+claimMode+" mode", func(t *testing.T) {
+			const (
+				workerCount  = 4
+				messageCount = 500
+				keyCount     = 10
+			)
+
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+			for i := 0; i < messageCount; i++ {
+				insertMessage(t, pool, "example", fmt.Sprintf("key-%d", i%keyCount), fmt.Sprint(i))
+			}
+
+			// Fail messages of some keys at random. The publisher calls Fail with its mutex held.
+			publisher := &publishertest.Publisher{Fail: func(m outbox.Message) error {
+				if m.Key[len(m.Key)-1]%2 == 0 && rand.IntN(3) == 0 { //nolint:gosec // Test failures don't need a secure random number generator.
+					return errNotEnoughReplicas
+				}
+				return nil
+			}}
+			cfg := Config{
+				BatchSize: 10,
+				ClaimMode: claimMode,
+				Ordering:  OrderingKey,
+				Retry:     RetryConfig{InitialBackoff: 1, MaxBackoff: 1, MaxAttempts: 1000},
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, workerCount)
+			for i := 0; i < workerCount; i++ {
+				w := newTestWorker(t, cfg, publisher, pool)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for countMessages(t, pool, outbox.StatusDelivered) < messageCount {
+						if _, err := w.sendMessages(ctx); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatalf("got %v error, want nil", err)
+			}
+
+			last := make(map[string]int)
+			for _, m := range publisher.Messages() {
+				var i int
+				if _, err := fmt.Sscan(string(m.Value), &i); err != nil {
+					t.Fatalf("failed to parse value: %v", err)
+				}
+				if prev, ok := last[string(m.Key)]; ok && i < prev {
+					t.Fatalf("got message %d of %s sent after message %d, want in order", i, m.Key, prev)
+				}
+				last[string(m.Key)] = i
+			}
+			if got, want := len(publisher.Messages()), messageCount; got != want {
+				t.Errorf("got %d sent messages, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestSendMessagesCommitOrder(t *testing.T) {
+	for _, claimMode := range []string{ClaimModeLock, ClaimModeLease} {
+		t.Run("Sends messages in commit order in "+claimMode+" mode", func(t *testing.T) {
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+
+			tx, err := pool.Begin(ctx)
+			if err != nil {
+				t.Fatalf("failed to begin transaction: %v", err)
+			}
+			defer func() {
+				_ = tx.Rollback(ctx)
+			}()
+			_, err = tx.Exec(
+				ctx,
+				`INSERT INTO outbox_messages (status, topic, key, value, headers) VALUES ($1, 'example', 'a', 'first', '[]')`,
+				outbox.StatusUndelivered,
+			)
+			if err != nil {
+				t.Fatalf("failed to insert message: %v", err)
+			}
+			insertMessage(t, pool, "example", "b", "second")
+
+			publisher := &publishertest.Publisher{}
+			w := newTestWorker(t, Config{ClaimMode: claimMode, CommitOrder: true}, publisher, pool)
+
+			// The transaction still in progress doesn't hold back the message committed after it started.
+
+			sent, err := w.sendMessages(ctx)
+			if err != nil || sent != 1 {
+				t.Fatalf("got %d, %v, want 1, nil", sent, err)
+			}
+
+			if err = tx.Commit(ctx); err != nil {
+				t.Fatalf("failed to commit transaction: %v", err)
+			}
+			if sent, err = w.sendMessages(ctx); err != nil || sent != 1 {
+				t.Fatalf("got %d, %v, want 1, nil", sent, err)
+			}
+			if got, want := sentValues(publisher), []string{"second", "first"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v sent, want %v", got, want)
+			}
+		})
+
+		t.Run("Sends retries before later messages in "+claimMode+" mode", func(t *testing.T) {
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+			insertMessage(t, pool, "example", "a", "first")
+			insertMessage(t, pool, "example", "b", "second")
+
+			publisher := &publishertest.Publisher{Err: errors.New("broker unavailable")}
+			cfg := Config{ClaimMode: claimMode, CommitOrder: true, Retry: RetryConfig{InitialBackoff: time.Millisecond}}
+			w := newTestWorker(t, cfg, publisher, pool)
+			if _, err := w.sendMessages(ctx); err != nil {
+				t.Fatalf("got %v error, want nil", err)
+			}
+
+			insertMessage(t, pool, "example", "c", "third")
+			publisher.Err = nil
+			time.Sleep(10 * time.Millisecond)
+			if sent, err := w.sendMessages(ctx); err != nil || sent != 3 {
+				t.Fatalf("got %d, %v, want 3, nil", sent, err)
+			}
+			if got, want := sentValues(publisher), []string{"first", "second", "third"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v sent, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAdvanceCursor(t *testing.T) {
+	t.Run("Moves the cursor up to the first unsettled message", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 3)
+
+		publisher := &publishertest.Publisher{}
+		w := newTestWorker(t, Config{CommitOrder: true, Cursor: true}, publisher, pool)
+		if sent, err := w.sendMessages(ctx); err != nil || sent != 3 {
+			t.Fatalf("got %d, %v, want 3, nil", sent, err)
+		}
+		insertMessage(t, pool, "example", "a", "failed")
+		publisher.Err = errors.New("broker unavailable")
+		if _, err := w.sendMessages(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+		insertMessage(t, pool, "example", "b", "pending")
+		if err := w.sequenceMessages(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if err := w.advanceCursor(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		var want int64
+		err := pool.QueryRow(
+			ctx,
+			`SELECT commit_seq - 1 FROM outbox_messages WHERE value = 'failed'`,
+		).Scan(&want)
+		if err != nil {
+			t.Fatalf("failed to query commit_seq: %v", err)
+		}
+		var got int64
+		err = pool.QueryRow(ctx, `SELECT position FROM outbox_cursors WHERE name = $1`, cursorName).Scan(&got)
+		if err != nil {
+			t.Fatalf("failed to query outbox_cursors: %v", err)
+		}
+		if got != want {
+			t.Errorf("got %d position, want %d", got, want)
+		}
+		if w.cursor != want {
+			t.Errorf("got %d cursor, want %d", w.cursor, want)
+		}
+	})
+
+	t.Run("Moves the cursor past every message once all are settled", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 3)
+
+		w := newTestWorker(t, Config{CommitOrder: true, Cursor: true}, &publishertest.Publisher{}, pool)
+		if sent, err := w.sendMessages(ctx); err != nil || sent != 3 {
+			t.Fatalf("got %d, %v, want 3, nil", sent, err)
+		}
+
+		if err := w.advanceCursor(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		var want int64
+		if err := pool.QueryRow(ctx, `SELECT max(commit_seq) FROM outbox_messages`).Scan(&want); err != nil {
+			t.Fatalf("failed to query commit_seq: %v", err)
+		}
+		if w.cursor != want {
+			t.Errorf("got %d cursor, want %d", w.cursor, want)
+		}
+	})
+}
+
+func TestSendMessagesPriority(t *testing.T) {
+	for _, claimMode := range []string{ClaimModeLock, ClaimModeLease} {
+		t.Run("Sends higher priorities first in "+claimMode+" mode", func(t *testing.T) {
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+			insertPrioritizedMessage(t, pool, "low-0", 0, "0 seconds")
+			insertPrioritizedMessage(t, pool, "high-0", 5, "0 seconds")
+			insertPrioritizedMessage(t, pool, "low-1", 0, "0 seconds")
+			insertPrioritizedMessage(t, pool, "high-1", 5, "0 seconds")
+
+			publisher := &publishertest.Publisher{}
+			cfg := Config{BatchSize: 2, ClaimMode: claimMode, Priority: PriorityConfig{Enabled: true}}
+			w := newTestWorker(t, cfg, publisher, pool)
+			if _, err := w.sendMessages(ctx); err != nil {
+				t.Fatalf("got %v error, want nil", err)
+			}
+
+			if got, want := sentValues(publisher), []string{"high-0", "high-1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v sent, want %v", got, want)
+			}
+		})
+
+		t.Run("Sends lower priorities that waited long enough first in "+claimMode+" mode", func(t *testing.T) {
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+			insertPrioritizedMessage(t, pool, "high", 5, "0 seconds")
+			insertPrioritizedMessage(t, pool, "low", 0, "10 minutes")
+
+			publisher := &publishertest.Publisher{}
+			cfg := Config{BatchSize: 1, ClaimMode: claimMode, Priority: PriorityConfig{Enabled: true, Aging: time.Minute}}
+			w := newTestWorker(t, cfg, publisher, pool)
+			if _, err := w.sendMessages(ctx); err != nil {
+				t.Fatalf("got %v error, want nil", err)
+			}
+
+			if got, want := sentValues(publisher), []string{"low"}; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v sent, want %v", got, want)
+			}
+		})
+	}
+}
+
+func sentValues(publisher *publishertest.Publisher) []string {
+	var values []string
+	for _, m := range publisher.Messages() {
+		values = append(values, string(m.Value))
+	}
+	return values
+}
+
+func insertPrioritizedMessage(t *testing.T, pool *pgxpool.Pool, value string, priority int, age string) {
+	t.Helper()
+
+	_, err := pool.Exec(
+		context.Background(),
+		`
+			INSERT INTO outbox_messages (created_at, status, topic, key, value, headers, priority)
+			VALUES (now() - $1::interval, $2, 'example', $3, $3, '[]', $4)
+		`,
+		age,
+		outbox.StatusUndelivered,
+		value,
+		priority,
+	)
+	if err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/k11v/outbox/internal/outbox"
+)
+
+// executor executes SQL statements.
+// It is implemented by *pgxpool.Pool and pgx.Tx.
+type executor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// publish publishes messages.
+// It returns the error of each message, which is nil for messages that were published.
+func (w *Worker) publish(ctx context.Context, messages []message) []error {
+	return w.publisher.Publish(ctx, newOutgoingMessages(messages, w.cfg.Metadata))
+}
+
+// deliver sends messages to the broker and records the results.
+// The results are recorded even if ctx is canceled in the meantime, so messages that were sent are always marked as
+// delivered. If the batch was aborted because the drain timeout was exceeded, messages that failed are released
+// without counting the attempt.
+// It returns the number of sent messages and whether the batch was aborted.
+func (w *Worker) deliver(ctx context.Context, db executor, messages []message, leased bool) (int, bool, error) {
+	errs := w.publish(ctx, messages)
+
+	aborted := errors.Is(context.Cause(ctx), errDrainTimeout)
+	dead := make([]bool, len(messages))
+	if !aborted {
+		dead = w.sendDeadLetters(ctx, messages, errs)
+	}
+
+	recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), w.cfg.timeout())
+	defer cancel()
+	sent, err := w.recordResults(recordCtx, db, messages, errs, dead, aborted, leased)
+	return sent, aborted, err
+}
+
+// recordResults records the results of an attempt to send messages.
+// Sent messages are marked as delivered. Dead messages are marked as dead. Other failed messages are released and
+// scheduled for another attempt after a backoff, or released right away if the attempt was aborted. If leased is
+// true, only messages still claimed by the worker are updated.
+// It returns the number of sent messages.
+func (w *Worker) recordResults(
+	ctx context.Context,
+	db executor,
+	messages []message,
+	errs []error,
+	dead []bool,
+	aborted bool,
+	leased bool,
+) (int, error) {
+	var sent []message
+	var released []message
+	var failed []message
+	var failedStatuses []string
+	var failedErrs []string
+	var failedDelays []*int64
+	for i, m := range messages {
+		if errs[i] == nil {
+			sent = append(sent, m)
+			continue
+		}
+		if aborted {
+			released = append(released, m)
+			continue
+		}
+
+		attempt := m.Attempts + 1
+		failed = append(failed, m)
+		failedErrs = append(failedErrs, errs[i].Error())
+		if dead[i] {
+			w.log.Error(
+				"moved message to dead letters",
+				"id", m.ID,
+				"topic", m.Topic,
+				"attempt", attempt,
+				"error", errs[i],
+			)
+			failedStatuses = append(failedStatuses, outbox.StatusDead)
+			failedDelays = append(failedDelays, nil)
+			continue
+		}
+
+		delay := w.cfg.Retry.backoff(attempt)
+		w.log.Warn(
+			"failed to send message",
+			"id", m.ID,
+			"topic", m.Topic,
+			"attempt", attempt,
+			"retry_in", delay,
+			"error", errs[i],
+		)
+		delayMilliseconds := delay.Milliseconds()
+		failedStatuses = append(failedStatuses, outbox.StatusUndelivered)
+		failedDelays = append(failedDelays, &delayMilliseconds)
+	}
+
+	args := pgx.NamedArgs{
+		"undelivered": outbox.StatusUndelivered,
+		"claimed":     outbox.StatusClaimed,
+		"delivered":   outbox.StatusDelivered,
+		"leased":      leased,
+		"workerID":    w.id,
+	}
+
+	if len(sent) > 0 {
+		args["ids"] = messageIDs(sent)
+		tag, err := db.Exec(
+			ctx,
+			`
+				UPDATE outbox_messages
+				SET status = @delivered, attempts = attempts + 1, last_error = NULL, next_attempt_at = NULL
+				WHERE id = ANY(@ids) AND (NOT @leased OR (status = @claimed AND claimed_by = @workerID))
+			`,
+			args,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update delivered outbox_messages: %w", err)
+		}
+		if lost := int64(len(sent)) - tag.RowsAffected(); lost > 0 {
+			w.log.Warn("lost lease on sent messages", "count", lost)
+		}
+	}
+
+	if len(released) > 0 {
+		w.log.Warn("released unsent messages of aborted batch", "count", len(released))
+		args["ids"] = messageIDs(released)
+		_, err := db.Exec(
+			ctx,
+			`
+				UPDATE outbox_messages
+				SET status = @undelivered, claimed_by = NULL, claimed_until = NULL
+				WHERE id = ANY(@ids) AND (NOT @leased OR (status = @claimed AND claimed_by = @workerID))
+			`,
+			args,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update released outbox_messages: %w", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		args["ids"] = messageIDs(failed)
+		args["statuses"] = failedStatuses
+		args["errors"] = failedErrs
+		args["delays"] = failedDelays
+		_, err := db.Exec(
+			ctx,
+			`
+				UPDATE outbox_messages m
+				SET status = f.status,
+					claimed_by = NULL,
+					claimed_until = NULL,
+					attempts = m.attempts + 1,
+					last_error = f.error,
+					next_attempt_at = now() + f.delay * interval '1 millisecond'
+				FROM unnest(@ids::uuid[], @statuses::text[], @errors::text[], @delays::bigint[])
+					AS f(id, status, error, delay)
+				WHERE m.id = f.id AND (NOT @leased OR (m.status = @claimed AND m.claimed_by = @workerID))
+			`,
+			args,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update failed outbox_messages: %w", err)
+		}
+	}
+
+	return len(sent), nil
+}
+
+// backoff returns the delay before the attempt that follows the given failed attempt.
+// The delay grows exponentially from the initial backoff up to the maximum backoff, and is randomized by the jitter
+// factor so that messages that failed together aren't retried together.
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	d := float64(c.initialBackoff()) * math.Pow(2, float64(attempt-1))
+	if maxBackoff := float64(c.maxBackoff()); d > maxBackoff {
+		d = maxBackoff
+	}
+	d *= 1 + c.jitter()*(2*rand.Float64()-1) //nolint:gosec // Jitter doesn't need a secure random number generator.
+	return time.Duration(d)
+}
@@ -0,0 +1,261 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/k11v/outbox/internal/publishertest"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Run("Grows exponentially up to the maximum with jitter", func(t *testing.T) {
+		cfg := RetryConfig{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Jitter: 0.5}
+		tests := []struct {
+			attempt int
+			base    time.Duration
+		}{
+			{attempt: 1, base: time.Second},
+			{attempt: 2, base: 2 * time.Second},
+			{attempt: 3, base: 4 * time.Second},
+			{attempt: 4, base: 8 * time.Second},
+			{attempt: 5, base: 10 * time.Second},
+			{attempt: 100, base: 10 * time.Second},
+		}
+
+		for _, tt := range tests {
+			for i := 0; i < 100; i++ {
+				got := cfg.backoff(tt.attempt)
+				if low, high := tt.base/2, tt.base*3/2; got < low || got > high {
+					t.Fatalf("got %v for attempt %d, want between %v and %v", got, tt.attempt, low, high)
+				}
+			}
+		}
+	})
+
+	t.Run("Doesn't randomize the backoff when jitter is negative", func(t *testing.T) {
+		var cfg RetryConfig
+		err := env.ParseWithOptions(&cfg, env.Options{Environment: map[string]string{
+			"INITIAL_BACKOFF": "1s",
+			"MAX_BACKOFF":     "10s",
+			"JITTER":          "-1",
+		}})
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		tests := []struct {
+			attempt int
+			want    time.Duration
+		}{
+			{attempt: 1, want: time.Second},
+			{attempt: 2, want: 2 * time.Second},
+			{attempt: 3, want: 4 * time.Second},
+			{attempt: 5, want: 10 * time.Second},
+		}
+
+		for _, tt := range tests {
+			if got := cfg.backoff(tt.attempt); got != tt.want {
+				t.Errorf("got %v for attempt %d, want %v", got, tt.attempt, tt.want)
+			}
+		}
+	})
+}
+
+func TestDeliver(t *testing.T) {
+	t.Run("Marks published messages as delivered and schedules failed ones", func(t *testing.T) {
+		messages := []message{
+			{ID: uuid.New(), Topic: "example", Value: "value-0"},
+			{ID: uuid.New(), Topic: "missing", Value: "value-1"},
+			{ID: uuid.New(), Topic: "example", Value: "value-2"},
+		}
+		publisher := &publishertest.Publisher{Fail: failTopic("missing")}
+		db := &fakeExecutor{}
+		w := newTestWorker(t, Config{}, publisher, nil)
+
+		sent, aborted, err := w.deliver(context.Background(), db, messages, false)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := sent, 2; got != want {
+			t.Errorf("got %d sent messages, want %d", got, want)
+		}
+		if aborted {
+			t.Errorf("got aborted batch, want not aborted")
+		}
+		if got, want := sentValues(publisher), []string{"value-0", "value-2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := len(db.args), 2; got != want {
+			t.Fatalf("got %d statements, want %d", got, want)
+		}
+		if got, want := db.args[0]["ids"], messageIDs([]message{messages[0], messages[2]}); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v delivered ids, want %v", got, want)
+		}
+		if got, want := db.args[1]["ids"], messageIDs(messages[1:2]); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v failed ids, want %v", got, want)
+		}
+		if got, want := db.args[1]["statuses"], []string{outbox.StatusUndelivered}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v statuses, want %v", got, want)
+		}
+		if got, want := db.args[1]["errors"], []string{errUnknownTopic.Error()}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v errors, want %v", got, want)
+		}
+	})
+
+	t.Run("Sends messages that ran out of attempts to dead letter topics", func(t *testing.T) {
+		messages := []message{{ID: uuid.New(), Topic: "example", Value: "value", Attempts: 2}}
+		publisher := &publishertest.Publisher{Fail: failTopic("example")}
+		db := &fakeExecutor{}
+		cfg := Config{Retry: RetryConfig{MaxAttempts: 3}, DeadLetter: DeadLetterConfig{Enabled: true}}
+		w := newTestWorker(t, cfg, publisher, nil)
+
+		if _, _, err := w.deliver(context.Background(), db, messages, false); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		msgs := publisher.Messages()
+		if got, want := len(msgs), 1; got != want {
+			t.Fatalf("got %d published messages, want %d", got, want)
+		}
+		if got, want := msgs[0].Topic, "example.dlt"; got != want {
+			t.Errorf("got %q topic, want %q", got, want)
+		}
+		if got, want := len(db.args), 1; got != want {
+			t.Fatalf("got %d statements, want %d", got, want)
+		}
+		if got, want := db.args[0]["statuses"], []string{outbox.StatusDead}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v statuses, want %v", got, want)
+		}
+	})
+
+	t.Run("Releases failed messages without an attempt when the drain timeout is exceeded", func(t *testing.T) {
+		messages := []message{{ID: uuid.New(), Topic: "example", Value: "value", Attempts: 2}}
+		publisher := &publishertest.Publisher{Delay: time.Hour}
+		db := &fakeExecutor{}
+		cfg := Config{Retry: RetryConfig{MaxAttempts: 3}, DeadLetter: DeadLetterConfig{Enabled: true}}
+		w := newTestWorker(t, cfg, publisher, nil)
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(errDrainTimeout)
+
+		sent, aborted, err := w.deliver(ctx, db, messages, false)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := sent, 0; got != want {
+			t.Errorf("got %d sent messages, want %d", got, want)
+		}
+		if !aborted {
+			t.Errorf("got batch not aborted, want aborted")
+		}
+		if got, want := len(publisher.Messages()), 0; got != want {
+			t.Errorf("got %d published messages, want %d", got, want)
+		}
+		if got, want := len(db.args), 1; got != want {
+			t.Fatalf("got %d statements, want %d", got, want)
+		}
+		if _, ok := db.args[0]["statuses"]; ok {
+			t.Errorf("got failed messages, want released messages")
+		}
+		if got, want := db.args[0]["ids"], messageIDs(messages); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v released ids, want %v", got, want)
+		}
+	})
+
+	t.Run("Returns error when results can't be recorded", func(t *testing.T) {
+		messages := []message{{ID: uuid.New(), Topic: "example", Value: "value"}}
+		db := &fakeExecutor{err: errors.New("connection is closed")}
+		w := newTestWorker(t, Config{}, &publishertest.Publisher{}, nil)
+
+		if _, _, err := w.deliver(context.Background(), db, messages, false); err == nil {
+			t.Errorf("got nil error, want non-nil")
+		}
+	})
+}
+
+// fakeExecutor is an executor that records the named arguments of executed statements.
+type fakeExecutor struct {
+	err  error // returned for every statement
+	args []pgx.NamedArgs
+}
+
+func (e *fakeExecutor) Exec(_ context.Context, _ string, arguments ...any) (pgconn.CommandTag, error) {
+	if e.err != nil {
+		return pgconn.CommandTag{}, e.err
+	}
+	args := make(pgx.NamedArgs)
+	for k, v := range arguments[0].(pgx.NamedArgs) {
+		args[k] = v
+	}
+	e.args = append(e.args, args)
+	return pgconn.NewCommandTag(fmt.Sprintf("UPDATE %d", len(args["ids"].([]uuid.UUID)))), nil
+}
+
+func TestSendMessagesRetry(t *testing.T) {
+	for _, claimMode := range []string{ClaimModeLock, ClaimModeLease} {
+		t.Run("Schedules failed messages for another attempt in "+claimMode+" mode", func(t *testing.T) {
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+			insertMessage(t, pool, "example", "key", "value-0")
+			insertMessage(t, pool, "missing", "key", "value-1")
+			insertMessage(t, pool, "example", "key", "value-2")
+
+			publisher := &publishertest.Publisher{Fail: failTopic("missing")}
+			cfg := Config{ClaimMode: claimMode, Retry: RetryConfig{InitialBackoff: time.Hour}}
+			w := newTestWorker(t, cfg, publisher, pool)
+
+			sent, err := w.sendMessages(ctx)
+			if err != nil {
+				t.Fatalf("got %v error, want nil", err)
+			}
+			if got, want := sent, 2; got != want {
+				t.Errorf("got %d sent messages, want %d", got, want)
+			}
+
+			var attempts int
+			var lastError string
+			var scheduled bool
+			err = pool.QueryRow(
+				ctx,
+				`
+					SELECT attempts, last_error, next_attempt_at > now()
+					FROM outbox_messages
+					WHERE status = $1 AND topic = 'missing'
+				`,
+				outbox.StatusUndelivered,
+			).Scan(&attempts, &lastError, &scheduled)
+			if err != nil {
+				t.Fatalf("failed to query failed message: %v", err)
+			}
+			if got, want := attempts, 1; got != want {
+				t.Errorf("got %d attempts, want %d", got, want)
+			}
+			if !strings.Contains(lastError, errUnknownTopic.Error()) {
+				t.Errorf("got %q last error, want it to contain %q", lastError, errUnknownTopic.Error())
+			}
+			if !scheduled {
+				t.Errorf("got next attempt not in the future, want in the future")
+			}
+
+			publishes := publisher.PublishCount()
+			if sent, err = w.sendMessages(ctx); err != nil || sent != 0 {
+				t.Errorf("got %d, %v, want 0, nil", sent, err)
+			}
+			if got, want := publisher.PublishCount(), publishes; got != want {
+				t.Errorf("got %d publishes, want %d", got, want)
+			}
+		})
+	}
+}
@@ -2,99 +2,399 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/k11v/outbox/internal/outbox"
-	"github.com/segmentio/kafka-go"
 )
 
-// Worker is a worker that sends messages from the outbox to Kafka.
+// Worker is a worker that sends messages from the outbox to a message broker.
 // It should be created with NewWorker.
 type Worker struct {
 	cfg          Config
+	id           string
 	log          *slog.Logger
-	kafkaWriter  *kafka.Writer
+	publisher    outbox.Publisher
 	postgresPool *pgxpool.Pool
+	wake         chan struct{}
+	backfilled   bool  // whether the messages missing from the replication stream were sent, see backfill
+	cursor       int64 // position of the commit order cursor, see advanceCursor
 }
 
-// NewWorker creates a new Worker.
-func NewWorker(cfg Config, log *slog.Logger, kafkaWriter *kafka.Writer, postgresPool *pgxpool.Pool) *Worker {
+// NewWorker creates a new Worker that sends messages with publisher, e.g. a kafkautil.Publisher.
+// It returns an error if the configuration is invalid.
+func NewWorker(cfg Config, log *slog.Logger, publisher outbox.Publisher, postgresPool *pgxpool.Pool) (*Worker, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	id := cfg.ID
+	if id == "" {
+		id = newID()
+	}
+
 	return &Worker{
 		cfg:          cfg,
-		kafkaWriter:  kafkaWriter,
-		log:          log,
+		id:           id,
+		log:          log.With("worker_id", id),
+		publisher:    publisher,
 		postgresPool: postgresPool,
+		wake:         make(chan struct{}, 1),
+	}, nil
+}
+
+// newID returns a worker ID made of the hostname and a random suffix.
+func newID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "worker"
 	}
+	return hostname + "-" + uuid.NewString()[:8]
 }
 
 // Run runs the worker.
-// It sends messages from the outbox to Kafka in batches every interval.
-// It stops when done is closed.
-func (w *Worker) Run(done <-chan struct{}) {
+// It sends messages from the outbox to the broker in batches every interval, and one batch after another without
+// waiting while batches are full.
+// If listening is enabled, it also sends messages as soon as it is notified about new ones.
+// If leader election is enabled, it sends messages only while it is the leader.
+// If change data capture is enabled, it reads messages from the logical replication stream instead.
+// It stops when ctx is canceled. A batch that is being sent then has the drain timeout to finish.
+func (w *Worker) Run(ctx context.Context) {
+	if w.cfg.CDC.Enabled {
+		w.runCDC(ctx)
+		return
+	}
+
+	if w.cfg.Listen {
+		listenCtx, cancel := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.listen(listenCtx)
+		}()
+		defer wg.Wait()
+		defer cancel()
+	}
+
+	if w.cfg.LeaderElection.Enabled {
+		w.runElected(ctx)
+		return
+	}
+
+	w.loop(ctx, func() bool {
+		w.sendBatch(ctx)
+		return true
+	})
+}
+
+// loop calls f immediately and then every interval or wake-up until ctx is canceled or f returns false.
+// It reports whether it stopped because ctx was canceled.
+func (w *Worker) loop(ctx context.Context, f func() bool) bool {
 	ticker := time.NewTicker(w.cfg.interval())
 	defer ticker.Stop()
 
 	for {
-		func() {
-			ctx, cancel := context.WithTimeout(context.Background(), w.cfg.timeout())
-			defer cancel()
-
-			count, err := w.sendMessages(ctx)
-			if err != nil {
-				w.log.Error("failed to send messages", "error", err)
-				return
-			}
-
-			if count > 0 {
-				w.log.Info("sent messages", "count", count)
-			} else {
-				w.log.Debug("sent no messages")
-			}
-		}()
+		if !f() {
+			return false
+		}
 
 		select {
 		case <-ticker.C:
-		case <-done:
-			return
+		case <-w.wake:
+		case <-ctx.Done():
+			return true
 		}
 	}
 }
 
+// errDrainTimeout is the cause of the cancellation of a batch that didn't finish within the drain timeout.
+var errDrainTimeout = errors.New("drain timeout exceeded")
+
+// batchContext returns the context of a batch that is sent while ctx is active.
+// The batch isn't canceled together with ctx but gets the drain timeout to finish, after which it is canceled with
+// errDrainTimeout as the cause.
+func (w *Worker) batchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	drainCtx, cancelDrain := context.WithCancelCause(context.WithoutCancel(ctx))
+	batchCtx, cancel := context.WithTimeout(drainCtx, w.cfg.timeout())
+	stop := context.AfterFunc(ctx, func() {
+		timer := time.AfterFunc(w.cfg.drainTimeout(), func() {
+			cancelDrain(errDrainTimeout)
+		})
+		context.AfterFunc(batchCtx, func() {
+			timer.Stop()
+		})
+	})
+
+	return batchCtx, func() {
+		stop()
+		cancel()
+		cancelDrain(context.Canceled)
+	}
+}
+
+// sendBatch sends a batch of messages and logs the result.
+func (w *Worker) sendBatch(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	batchCtx, cancel := w.batchContext(ctx)
+	defer cancel()
+
+	count, err := w.sendMessages(batchCtx)
+	if err != nil {
+		w.log.Error("failed to send messages", "error", err)
+		return
+	}
+
+	if count > 0 {
+		w.log.Info("sent messages", "count", count)
+	} else {
+		w.log.Debug("sent no messages")
+	}
+}
+
+// sendMessages sends a batch of undelivered messages from the outbox to the broker.
+// The batch is claimed according to the configured claim mode. Messages that fail to be sent are scheduled for
+// another attempt without failing the batch.
+// It returns the number of sent messages.
 func (w *Worker) sendMessages(ctx context.Context) (int, error) {
-	// Get undelivered messages.
+	if err := w.expireMessages(ctx); err != nil {
+		return 0, err
+	}
+	if err := w.promoteScheduled(ctx); err != nil {
+		return 0, err
+	}
+	if w.cfg.CommitOrder {
+		if err := w.sequenceMessages(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if w.cfg.Cursor {
+		if err := w.advanceCursor(ctx); err != nil {
+			return 0, err
+		}
+	}
 
-	result, err := w.postgresPool.Query(
+	switch w.cfg.claimMode() {
+	case ClaimModeLease:
+		return w.sendMessagesLeased(ctx)
+	default:
+		return w.sendMessagesLocked(ctx)
+	}
+}
+
+// expireMessages makes messages that weren't sent before expires_at expired, so they are never sent.
+// Messages locked by other workers are skipped and expire on a later call unless they are sent in the meantime.
+func (w *Worker) expireMessages(ctx context.Context) error {
+	tag, err := w.postgresPool.Exec(
 		ctx,
 		`
-			SELECT id, topic, key, value, headers::jsonb
-			FROM outbox_messages
-			WHERE status = $1
-			ORDER BY created_at, id
-			LIMIT $2
+			UPDATE outbox_messages
+			SET status = @expired, claimed_by = NULL, claimed_until = NULL
+			WHERE id IN (
+				SELECT id
+				FROM outbox_messages
+				WHERE (status IN (@scheduled, @undelivered) OR (status = @claimed AND claimed_until < now()))
+					AND expires_at <= now()
+				FOR UPDATE SKIP LOCKED
+			)
 		`,
+		pgx.NamedArgs{
+			"expired":     outbox.StatusExpired,
+			"scheduled":   outbox.StatusScheduled,
+			"undelivered": outbox.StatusUndelivered,
+			"claimed":     outbox.StatusClaimed,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update expired outbox_messages: %w", err)
+	}
+	if count := tag.RowsAffected(); count > 0 {
+		w.log.Info("expired messages", "count", count)
+	}
+	return nil
+}
+
+// promoteScheduled makes scheduled messages whose time has come undelivered.
+// Scheduled messages are kept out of the candidates until then, so messages scheduled far ahead don't slow down
+// claiming.
+func (w *Worker) promoteScheduled(ctx context.Context) error {
+	tag, err := w.postgresPool.Exec(
+		ctx,
+		`UPDATE outbox_messages SET status = $1 WHERE status = $2 AND deliver_after <= now()`,
 		outbox.StatusUndelivered,
-		w.cfg.batchSize(),
+		outbox.StatusScheduled,
 	)
 	if err != nil {
-		return 0, fmt.Errorf("failed to query outbox_messages: %w", err)
+		return fmt.Errorf("failed to update scheduled outbox_messages: %w", err)
 	}
+	if count := tag.RowsAffected(); count > 0 {
+		w.log.Debug("promoted scheduled messages", "count", count)
+	}
+	return nil
+}
 
-	type row struct {
-		ID      uuid.UUID `json:"id"`
-		Topic   string    `json:"topic"`
-		Key     string    `json:"key"`
-		Value   string    `json:"value"`
-		Headers []struct {
-			Key   string `json:"key"`
-			Value string `json:"value"`
-		}
+// messageColumns are the columns of outbox_messages that are scanned into message.
+const messageColumns = `id, seq, created_at, topic, key, value, headers, attempts, expires_at`
+
+// candidatesQuery selects messages that can be claimed in the order they should be sent and locks them.
+// It takes the selected columns and the order as format arguments and claimArgs as named arguments.
+// Without priorities, messages are sent in the order of the IDs of the transactions that inserted them and then in the
+// order of insertion. Transaction IDs are assigned when transactions start, so this isn't the commit order. In commit
+// order mode, only messages with a commit sequence number past the cursor can be claimed, and they are sent in the
+// order of those numbers, see sequenceMessages.
+// With key ordering, only the oldest undelivered message of each topic and key can be claimed, so a message is never
+// sent while an older one with the same key is being sent by another worker or waits for another attempt.
+const candidatesQuery = `
+	SELECT %s
+	FROM outbox_messages
+	WHERE (status = @undelivered OR (status = @claimed AND claimed_until < now()))
+		AND (next_attempt_at IS NULL OR next_attempt_at <= now())
+		AND (expires_at IS NULL OR expires_at > now())
+		AND (attempts > 0 OR deliver_after IS NOT NULL OR NOT @retriesOnly)
+		AND (NOT @commitOrder OR commit_seq > @cursor)
+		AND (NOT @orderedByKey OR NOT EXISTS (
+			SELECT 1
+			FROM outbox_messages older
+			WHERE older.topic = outbox_messages.topic
+				AND older.key = outbox_messages.key
+				AND older.status IN (@undelivered, @claimed)
+				AND CASE
+					WHEN @commitOrder THEN older.commit_seq < outbox_messages.commit_seq
+					ELSE (older.xid, older.seq) < (outbox_messages.xid, outbox_messages.seq)
+				END
+		))
+	ORDER BY %s
+	LIMIT @batchSize
+	FOR UPDATE SKIP LOCKED
+`
+
+// fifoOrder and commitSeqOrder are the orders of candidates without priorities, by insertion and by commit.
+const (
+	fifoOrder      = `xid, seq`
+	commitSeqOrder = `commit_seq`
+)
+
+// priorityOrder is the order of candidates with priorities, followed by fifoOrder or commitSeqOrder.
+// The priority of a message is raised by one for every aging period it has been due, so messages with a low priority
+// are eventually sent even while messages with a higher priority keep coming.
+const priorityOrder = `
+	priority + floor(extract(epoch FROM now() - coalesce(deliver_after, created_at)) / @agingSeconds) DESC
+`
+
+// messageSize is the SQL expression of the size of a message that counts towards the batch size in bytes.
+const messageSize = `octet_length(key) + octet_length(value)`
+
+// fifoBatchQuery and priorityBatchQuery select the IDs of the next batch without and with priorities, and
+// commitBatchQuery and commitPriorityBatchQuery do the same in commit order mode.
+var (
+	fifoBatchQuery           = newBatchQuery(fifoOrder)
+	priorityBatchQuery       = newBatchQuery(priorityOrder + ", " + fifoOrder)
+	commitBatchQuery         = newBatchQuery(commitSeqOrder)
+	commitPriorityBatchQuery = newBatchQuery(priorityOrder + ", " + commitSeqOrder)
+)
+
+// newBatchQuery returns a query that selects the IDs of the next batch among the candidates in the order and locks
+// the candidates. The query takes claimArgs as named arguments. If the batch size in bytes is limited, the batch ends
+// with the message that reaches the limit.
+func newBatchQuery(order string) string {
+	return fmt.Sprintf(
+		`
+			SELECT id
+			FROM (
+				SELECT id, sum(size) OVER (ORDER BY %[1]s) - size AS preceding_size
+				FROM (%[2]s) candidates
+			) sized
+			WHERE @batchBytes = 0 OR preceding_size < @batchBytes
+		`,
+		order,
+		fmt.Sprintf(
+			candidatesQuery,
+			"id, xid, seq, commit_seq, priority, created_at, deliver_after, "+messageSize+" AS size",
+			order,
+		),
+	)
+}
+
+// batchQuery returns the query that selects the IDs of the next batch.
+func (w *Worker) batchQuery() string {
+	switch {
+	case w.cfg.CommitOrder && w.cfg.Priority.Enabled:
+		return commitPriorityBatchQuery
+	case w.cfg.CommitOrder:
+		return commitBatchQuery
+	case w.cfg.Priority.Enabled:
+		return priorityBatchQuery
+	default:
+		return fifoBatchQuery
+	}
+}
+
+// sendOrder returns the order in which the messages of a batch are sent.
+func (w *Worker) sendOrder() string {
+	if w.cfg.CommitOrder {
+		return commitSeqOrder
+	}
+	return fifoOrder
+}
+
+// claimArgs returns the named arguments of candidatesQuery.
+func (w *Worker) claimArgs() pgx.NamedArgs {
+	return pgx.NamedArgs{
+		"undelivered":  outbox.StatusUndelivered,
+		"claimed":      outbox.StatusClaimed,
+		"retriesOnly":  w.cfg.CDC.Enabled && w.backfilled, // new messages except scheduled ones are sent from the stream
+		"commitOrder":  w.cfg.CommitOrder,
+		"cursor":       w.cursor,
+		"orderedByKey": w.cfg.ordering() == OrderingKey,
+		"batchSize":    w.cfg.batchSize(),
+		"batchBytes":   w.cfg.BatchBytes,
+		"agingSeconds": w.cfg.Priority.aging().Seconds(),
+	}
+}
+
+// sendMessagesLocked sends a batch of messages claimed with row locks.
+// The locks are held until the results are recorded, so concurrent workers skip each other's batches instead of
+// sending the same messages twice.
+func (w *Worker) sendMessagesLocked(ctx context.Context) (int, error) {
+	tx, err := w.postgresPool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func(tx pgx.Tx) {
+		_ = tx.Rollback(ctx)
+	}(tx)
+
+	// Claim undelivered messages.
+
+	result, err := tx.Query(
+		ctx,
+		fmt.Sprintf(
+			`
+				SELECT %s
+				FROM outbox_messages
+				WHERE id IN (%s)
+				ORDER BY %s
+			`,
+			messageColumns,
+			w.batchQuery(),
+			w.sendOrder(),
+		),
+		w.claimArgs(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query outbox_messages: %w", err)
 	}
-	rows, err := pgx.CollectRows(result, pgx.RowToStructByName[row])
+	rows, err := pgx.CollectRows(result, pgx.RowToStructByName[message])
 	if err != nil {
 		return 0, fmt.Errorf("failed to collect rows: %w", err)
 	}
@@ -102,47 +402,109 @@ func (w *Worker) sendMessages(ctx context.Context) (int, error) {
 	if len(rows) == 0 {
 		return 0, nil
 	}
+	w.wakeUpIfFull(rows)
 
-	// Send messages.
+	// Send messages and record the results.
 
-	var messages []kafka.Message
-	for _, mr := range rows {
-		headers := make([]kafka.Header, len(mr.Headers))
-		for i, header := range mr.Headers {
-			headers[i] = kafka.Header{
-				Key:   header.Key,
-				Value: []byte(header.Value),
-			}
-		}
-		m := kafka.Message{
-			Topic:   mr.Topic,
-			Key:     []byte(mr.Key),
-			Value:   []byte(mr.Value),
-			Headers: headers,
-		}
-		messages = append(messages, m)
+	sent, _, err := w.deliver(ctx, tx, rows, false)
+	if err != nil {
+		return 0, err
 	}
 
-	if err = w.kafkaWriter.WriteMessages(ctx, messages...); err != nil {
-		return 0, fmt.Errorf("failed to write messages: %w", err)
+	// Commit even if the batch was aborted meanwhile, otherwise sent messages wouldn't be marked as delivered.
+
+	commitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), w.cfg.timeout())
+	defer cancel()
+	if err = tx.Commit(commitCtx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	// Update status of messages.
+	return sent, nil
+}
 
-	var ids []uuid.UUID
-	for _, mr := range rows {
-		ids = append(ids, mr.ID)
-	}
+// sendMessagesLeased sends a batch of messages claimed with a lease.
+// The batch is claimed by setting claimed_by and claimed_until, sent outside of any transaction and then marked as
+// delivered. Messages whose lease has expired can be claimed by other workers.
+func (w *Worker) sendMessagesLeased(ctx context.Context) (int, error) {
+	// Claim undelivered messages and messages with expired leases.
 
-	_, err = w.postgresPool.Exec(
+	args := w.claimArgs()
+	args["workerID"] = w.id
+	args["leaseMilliseconds"] = w.cfg.leaseDuration().Milliseconds()
+	result, err := w.postgresPool.Query(
 		ctx,
-		`UPDATE outbox_messages SET status = $1 WHERE id = ANY($2)`,
-		outbox.StatusDelivered,
-		ids,
+		fmt.Sprintf(
+			`
+				WITH claimed AS (
+					UPDATE outbox_messages
+					SET status = @claimed,
+						claimed_by = @workerID,
+						claimed_until = now() + @leaseMilliseconds * interval '1 millisecond'
+					WHERE id IN (%s)
+					RETURNING %[2]s, xid, commit_seq
+				)
+				SELECT %[2]s
+				FROM claimed
+				ORDER BY %[3]s
+			`,
+			w.batchQuery(),
+			messageColumns,
+			w.sendOrder(),
+		),
+		args,
 	)
 	if err != nil {
-		return 0, fmt.Errorf("failed to update outbox_messages: %w", err)
+		return 0, fmt.Errorf("failed to claim outbox_messages: %w", err)
+	}
+	rows, err := pgx.CollectRows(result, pgx.RowToStructByName[message])
+	if err != nil {
+		return 0, fmt.Errorf("failed to collect rows: %w", err)
 	}
 
-	return len(messages), nil
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	w.wakeUpIfFull(rows)
+
+	// Send messages and record the results.
+	// Messages that were reclaimed by another worker after the lease expired are left to that worker.
+
+	sent, _, err := w.deliver(ctx, w.postgresPool, rows, true)
+	return sent, err
+}
+
+// wakeUpIfFull makes the worker send the next batch without waiting for the interval if the batch is full, because
+// more messages are likely waiting in the outbox.
+func (w *Worker) wakeUpIfFull(batch []message) {
+	size := 0
+	for _, m := range batch {
+		size += len(m.Key) + len(m.Value) // same as messageSize
+	}
+	if len(batch) >= w.cfg.batchSize() || (w.cfg.BatchBytes > 0 && size >= w.cfg.BatchBytes) {
+		w.wakeUp()
+	}
+}
+
+// acquireConn takes a dedicated connection out of the pool.
+// The connection is no longer managed by the pool, so session state such as advisory locks and LISTEN
+// registrations lives until the connection is closed.
+func (w *Worker) acquireConn() (*pgx.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.timeout())
+	defer cancel()
+
+	poolConn, err := w.postgresPool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return poolConn.Hijack(), nil
+}
+
+// closeConn closes a dedicated connection, which releases its session state.
+func (w *Worker) closeConn(conn *pgx.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.timeout())
+	defer cancel()
+
+	if err := conn.Close(ctx); err != nil {
+		w.log.Error("failed to close dedicated connection", "error", err)
+	}
 }
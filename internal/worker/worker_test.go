@@ -0,0 +1,508 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/k11v/outbox/internal/outbox"
+	"github.com/k11v/outbox/internal/postgrestest"
+	"github.com/k11v/outbox/internal/publishertest"
+)
+
+func TestSendMessages(t *testing.T) {
+	for _, claimMode := range []string{ClaimModeLock, ClaimModeLease} {
+		t.Run("Sends each message once with concurrent workers in "+claimMode+" mode", func(t *testing.T) {
+			const (
+				workerCount  = 4
+				messageCount = 1000
+			)
+
+			ctx := context.Background()
+			pool := postgrestest.NewPool(t)
+			insertMessages(t, pool, messageCount)
+
+			publisher := &publishertest.Publisher{Delay: time.Millisecond}
+			var wg sync.WaitGroup
+			errs := make(chan error, workerCount)
+			for i := 0; i < workerCount; i++ {
+				w := newTestWorker(t, Config{BatchSize: 10, ClaimMode: claimMode}, publisher, pool)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						count, err := w.sendMessages(ctx)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if count == 0 {
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatalf("got %v error, want nil", err)
+			}
+
+			seen := make(map[string]int)
+			for _, m := range publisher.Messages() {
+				seen[string(m.Value)]++
+			}
+			if got, want := len(seen), messageCount; got != want {
+				t.Errorf("got %d distinct messages, want %d", got, want)
+			}
+			for value, count := range seen {
+				if count != 1 {
+					t.Errorf("got message %s sent %d times, want 1", value, count)
+				}
+			}
+			if got, want := countMessages(t, pool, outbox.StatusDelivered), messageCount; got != want {
+				t.Errorf("got %d delivered messages, want %d", got, want)
+			}
+		})
+	}
+
+	t.Run("Limits the batch by bytes", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 5) // 12 bytes of key and value each
+
+		publisher := &publishertest.Publisher{}
+		w := newTestWorker(t, Config{BatchBytes: 30}, publisher, pool)
+		count, err := w.sendMessages(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := count, 3; got != want {
+			t.Errorf("got %d sent messages, want %d", got, want)
+		}
+		select {
+		case <-w.wake:
+		default:
+			t.Errorf("got no wake-up after a full batch, want wake-up")
+		}
+	})
+
+	t.Run("Sends scheduled messages only once they are due", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertScheduledMessage(t, pool, "value-due", time.Now().Add(-time.Second))
+		insertScheduledMessage(t, pool, "value-later", time.Now().Add(time.Hour))
+
+		publisher := &publishertest.Publisher{}
+		w := newTestWorker(t, Config{}, publisher, pool)
+		count, err := w.sendMessages(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := count, 1; got != want {
+			t.Fatalf("got %d sent messages, want %d", got, want)
+		}
+		if got, want := string(publisher.Messages()[0].Value), "value-due"; got != want {
+			t.Errorf("got %q sent, want %q", got, want)
+		}
+		if got, want := countMessages(t, pool, outbox.StatusScheduled), 1; got != want {
+			t.Errorf("got %d scheduled messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Expires messages instead of sending them", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 2)
+		_, err := pool.Exec(
+			ctx,
+			`UPDATE outbox_messages SET expires_at = now() - interval '1 second' WHERE value = 'value-0'`,
+		)
+		if err != nil {
+			t.Fatalf("failed to expire message: %v", err)
+		}
+
+		publisher := &publishertest.Publisher{}
+		w := newTestWorker(t, Config{}, publisher, pool)
+		count, err := w.sendMessages(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := count, 1; got != want {
+			t.Fatalf("got %d sent messages, want %d", got, want)
+		}
+		if got, want := string(publisher.Messages()[0].Value), "value-1"; got != want {
+			t.Errorf("got %q sent, want %q", got, want)
+		}
+		if got, want := countMessages(t, pool, outbox.StatusExpired), 1; got != want {
+			t.Errorf("got %d expired messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Reclaims messages with expired leases in lease mode", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 2)
+		_, err := pool.Exec(
+			ctx,
+			`
+				UPDATE outbox_messages
+				SET status = $1, claimed_by = 'other', claimed_until = now() - interval '1 second'
+				WHERE value = 'value-0'
+			`,
+			outbox.StatusClaimed,
+		)
+		if err != nil {
+			t.Fatalf("failed to claim message: %v", err)
+		}
+		_, err = pool.Exec(
+			ctx,
+			`
+				UPDATE outbox_messages
+				SET status = $1, claimed_by = 'other', claimed_until = now() + interval '1 hour'
+				WHERE value = 'value-1'
+			`,
+			outbox.StatusClaimed,
+		)
+		if err != nil {
+			t.Fatalf("failed to claim message: %v", err)
+		}
+
+		publisher := &publishertest.Publisher{}
+		w := newTestWorker(t, Config{ClaimMode: ClaimModeLease}, publisher, pool)
+		count, err := w.sendMessages(ctx)
+		if err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		if got, want := count, 1; got != want {
+			t.Fatalf("got %d sent messages, want %d", got, want)
+		}
+		if got, want := string(publisher.Messages()[0].Value), "value-0"; got != want {
+			t.Errorf("got %q sent, want %q", got, want)
+		}
+		if got, want := countMessages(t, pool, outbox.StatusClaimed), 1; got != want {
+			t.Errorf("got %d claimed messages, want %d", got, want)
+		}
+	})
+
+	t.Run("Releases the lease when sending fails in lease mode", func(t *testing.T) {
+		ctx := context.Background()
+		pool := postgrestest.NewPool(t)
+		insertMessages(t, pool, 3)
+
+		publisher := &publishertest.Publisher{Err: errors.New("broker is unavailable")}
+		w := newTestWorker(t, Config{ClaimMode: ClaimModeLease}, publisher, pool)
+		if _, err := w.sendMessages(ctx); err != nil {
+			t.Fatalf("got %v error, want nil", err)
+		}
+
+		var count int
+		err := pool.QueryRow(
+			ctx,
+			`
+				SELECT COUNT(*)
+				FROM outbox_messages
+				WHERE status = $1
+					AND claimed_by IS NULL
+					AND claimed_until IS NULL
+					AND attempts = 1
+					AND last_error IS NOT NULL
+					AND next_attempt_at > now()
+			`,
+			outbox.StatusUndelivered,
+		).Scan(&count)
+		if err != nil {
+			t.Fatalf("failed to count released messages: %v", err)
+		}
+		if got, want := count, 3; got != want {
+			t.Errorf("got %d released messages scheduled for another attempt, want %d", got, want)
+		}
+	})
+}
+
+func TestRun(t *testing.T) {
+	for _, claimMode := range []string{ClaimModeLock, ClaimModeLease} {
+		t.Run("Finishes the batch being sent on shutdown in "+claimMode+" mode", func(t *testing.T) {
+			const messageCount = 10
+
+			pool := postgrestest.NewPool(t)
+			insertMessages(t, pool, messageCount)
+
+			publisher := &publishertest.Publisher{Delay: 500 * time.Millisecond}
+			w := newTestWorker(t, Config{ClaimMode: claimMode}, publisher, pool)
+			stop := runWorker(w)
+			waitForClaim(t, pool, claimMode)
+			stop()
+
+			if got, want := len(publisher.Messages()), messageCount; got != want {
+				t.Errorf("got %d sent messages, want %d", got, want)
+			}
+			if got, want := countMessages(t, pool, outbox.StatusDelivered), messageCount; got != want {
+				t.Errorf("got %d delivered messages, want %d", got, want)
+			}
+		})
+
+		t.Run("Aborts the batch being sent after the drain timeout in "+claimMode+" mode", func(t *testing.T) {
+			const messageCount = 10
+
+			pool := postgrestest.NewPool(t)
+			insertMessages(t, pool, messageCount)
+
+			publisher := &publishertest.Publisher{Delay: time.Hour}
+			cfg := Config{ClaimMode: claimMode, DrainTimeout: 100 * time.Millisecond}
+			w := newTestWorker(t, cfg, publisher, pool)
+			stop := runWorker(w)
+			waitForClaim(t, pool, claimMode)
+
+			start := time.Now()
+			stop()
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("got worker stopped in %v, want within the drain timeout", elapsed)
+			}
+
+			if got, want := countMessages(t, pool, outbox.StatusUndelivered), messageCount; got != want {
+				t.Errorf("got %d undelivered messages, want %d", got, want)
+			}
+			var attempts int
+			err := pool.QueryRow(context.Background(), `SELECT COALESCE(SUM(attempts), 0) FROM outbox_messages`).
+				Scan(&attempts)
+			if err != nil {
+				t.Fatalf("failed to query attempts: %v", err)
+			}
+			if got, want := attempts, 0; got != want {
+				t.Errorf("got %d attempts, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestRunBacklog(t *testing.T) {
+	for _, claimMode := range []string{ClaimModeLock, ClaimModeLease} {
+		t.Run("Drains a backlog without waiting for the interval in "+claimMode+" mode", func(t *testing.T) {
+			const messageCount = 100
+
+			pool := postgrestest.NewPool(t)
+			insertMessages(t, pool, messageCount)
+
+			cfg := Config{BatchSize: 10, ClaimMode: claimMode, Interval: time.Hour}
+			w := newTestWorker(t, cfg, &publishertest.Publisher{}, pool)
+			stop := runWorker(w)
+			defer stop()
+
+			drained := waitFor(func() bool {
+				return countMessages(t, pool, outbox.StatusDelivered) == messageCount
+			})
+			if !drained {
+				t.Errorf("got %d delivered messages, want %d", countMessages(t, pool, outbox.StatusDelivered), messageCount)
+			}
+		})
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+	const messageCount = 10000
+
+	benchmarks := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "Lock mode with 100 messages per batch", cfg: Config{BatchSize: 100}},
+		{name: "Lock mode with 1000 messages per batch", cfg: Config{BatchSize: 1000}},
+		{name: "Lock mode with 64 KiB per batch", cfg: Config{BatchSize: 1000, BatchBytes: 64 << 10}},
+		{name: "Lease mode with 100 messages per batch", cfg: Config{BatchSize: 100, ClaimMode: ClaimModeLease}},
+		{name: "Lease mode with 1000 messages per batch", cfg: Config{BatchSize: 1000, ClaimMode: ClaimModeLease}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx := context.Background()
+			pool := postgrestest.NewPool(b)
+			_, err := pool.Exec(
+				ctx,
+				`
+					INSERT INTO outbox_messages (status, topic, key, value, headers)
+					SELECT $1, 'example', 'key-' || i % 10, repeat('v', 100), '[]'
+					FROM generate_series(1, $2) AS i
+				`,
+				outbox.StatusUndelivered,
+				messageCount,
+			)
+			if err != nil {
+				b.Fatalf("failed to insert messages: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				_, err = pool.Exec(ctx, `UPDATE outbox_messages SET status = $1, attempts = 0`, outbox.StatusUndelivered)
+				if err != nil {
+					b.Fatalf("failed to reset messages: %v", err)
+				}
+				publisher := &publishertest.Publisher{}
+				w := newTestWorker(b, bm.cfg, publisher, pool)
+				b.StartTimer()
+
+				stop := runWorker(w)
+				for len(publisher.Messages()) < messageCount {
+					time.Sleep(time.Millisecond)
+				}
+				stop()
+			}
+			b.ReportMetric(float64(messageCount*b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+func TestBatchContext(t *testing.T) {
+	t.Run("Outlives the worker context until the drain timeout", func(t *testing.T) {
+		w := &Worker{cfg: Config{DrainTimeout: 50 * time.Millisecond}}
+		ctx, cancel := context.WithCancel(context.Background())
+		batchCtx, cancelBatch := w.batchContext(ctx)
+		defer cancelBatch()
+
+		cancel()
+		select {
+		case <-batchCtx.Done():
+			t.Fatalf("got batch canceled together with the worker, want canceled after the drain timeout")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		select {
+		case <-batchCtx.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("got batch not canceled, want canceled after the drain timeout")
+		}
+		if got, want := context.Cause(batchCtx), errDrainTimeout; !errors.Is(got, want) {
+			t.Errorf("got %v cause, want %v", got, want)
+		}
+	})
+
+	t.Run("Isn't aborted when it finishes before shutdown", func(t *testing.T) {
+		w := &Worker{cfg: Config{DrainTimeout: time.Millisecond}}
+		ctx, cancel := context.WithCancel(context.Background())
+		batchCtx, cancelBatch := w.batchContext(ctx)
+		cancelBatch()
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+
+		if got := context.Cause(batchCtx); errors.Is(got, errDrainTimeout) {
+			t.Errorf("got %v cause, want %v", got, context.Canceled)
+		}
+	})
+}
+
+// waitForClaim waits until the worker claims messages, which means it is sending a batch.
+func waitForClaim(t *testing.T, pool *pgxpool.Pool, claimMode string) {
+	t.Helper()
+
+	claimed := waitFor(func() bool {
+		if claimMode == ClaimModeLease {
+			return countMessages(t, pool, outbox.StatusClaimed) > 0
+		}
+		var locked bool
+		err := pool.QueryRow(
+			context.Background(),
+			`SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'transactionid' AND granted AND pid <> pg_backend_pid())`,
+		).Scan(&locked)
+		return err == nil && locked
+	})
+	if !claimed {
+		t.Fatalf("got no claimed messages, want claimed")
+	}
+}
+
+func newTestWorker(t testing.TB, cfg Config, publisher outbox.Publisher, pool *pgxpool.Pool) *Worker {
+	t.Helper()
+
+	w, err := NewWorker(cfg, slog.Default(), publisher, pool)
+	if err != nil {
+		t.Fatalf("failed to create worker: %v", err)
+	}
+	return w
+}
+
+var (
+	errUnknownTopic      = errors.New("unknown topic or partition")
+	errNotEnoughReplicas = errors.New("not enough replicas")
+)
+
+// failTopic returns a publishertest.Publisher.Fail function that fails messages of topic with errUnknownTopic.
+func failTopic(topic string) func(outbox.Message) error {
+	return func(m outbox.Message) error {
+		if m.Topic == topic {
+			return errUnknownTopic
+		}
+		return nil
+	}
+}
+
+func insertMessages(t testing.TB, pool *pgxpool.Pool, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		insertMessage(t, pool, "example", fmt.Sprintf("key-%d", i%10), fmt.Sprintf("value-%d", i))
+	}
+}
+
+func insertMessage(t testing.TB, pool *pgxpool.Pool, topic, key, value string) {
+	t.Helper()
+
+	_, err := pool.Exec(
+		context.Background(),
+		`INSERT INTO outbox_messages (status, topic, key, value, headers) VALUES ($1, $2, $3, $4, $5)`,
+		outbox.StatusUndelivered,
+		topic,
+		key,
+		value,
+		"[]",
+	)
+	if err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+}
+
+func insertScheduledMessage(t testing.TB, pool *pgxpool.Pool, value string, deliverAfter time.Time) {
+	t.Helper()
+
+	_, err := pool.Exec(
+		context.Background(),
+		`
+			INSERT INTO outbox_messages (status, topic, key, value, headers, deliver_after)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`,
+		outbox.StatusScheduled,
+		"example",
+		"key",
+		value,
+		"[]",
+		deliverAfter,
+	)
+	if err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+}
+
+func countMessages(t testing.TB, pool *pgxpool.Pool, status string) int {
+	t.Helper()
+
+	var count int
+	err := pool.QueryRow(
+		context.Background(),
+		`SELECT COUNT(*) FROM outbox_messages WHERE status = $1`,
+		status,
+	).Scan(&count)
+	if err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	return count
+}